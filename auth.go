@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sessionCookieName is the cookie AdGuard Home issues from /control/login.
+const sessionCookieName = "agh_session"
+
+// authMode returns ADGUARD_AUTH_MODE (basic, cookie or none). An empty mode
+// means basic.
+func authMode() string {
+	return strings.ToLower(os.Getenv("ADGUARD_AUTH_MODE"))
+}
+
+// sessions caches the session cookie per host and user, so each set of
+// per-endpoint credentials logs in once.
+var sessions = struct {
+	sync.Mutex
+	cookies map[string]*http.Cookie
+}{cookies: map[string]*http.Cookie{}}
+
+func sessionKey(host, user string) string {
+	return host + "|" + user
+}
+
+// sessionCookie returns the cached session for the endpoint's credentials on
+// c's host, logging in through /control/login when there is none yet.
+func sessionCookie(ctx context.Context, c *Client, endpoint string) (*http.Cookie, error) {
+	user, pass := c.credentials(endpoint)
+	key := sessionKey(c.Host, user)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+	if cookie, ok := sessions.cookies[key]; ok {
+		return cookie, nil
+	}
+	cookie, err := loginSession(ctx, c, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	sessions.cookies[key] = cookie
+	logX("DEBUG", "Obtained AdGuard session for user %q on %s", user, c.Host)
+	return cookie, nil
+}
+
+// invalidateSession drops the cached session so the next request logs in again.
+func invalidateSession(c *Client, endpoint string) {
+	user, _ := c.credentials(endpoint)
+	sessions.Lock()
+	delete(sessions.cookies, sessionKey(c.Host, user))
+	sessions.Unlock()
+}
+
+// loginSession posts the credentials to /control/login and returns the
+// session cookie AdGuard sets in response.
+func loginSession(ctx context.Context, c *Client, user, pass string) (*http.Cookie, error) {
+	body, err := json.Marshal(map[string]string{"name": user, "password": pass})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpointURL(c.Host, "/control/login"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("session login rejected with status %d", resp.StatusCode)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie, nil
+		}
+	}
+	return nil, errors.New("login response did not set an " + sessionCookieName + " cookie")
+}
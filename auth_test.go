@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeSessionServer issues agh_session cookies from /control/login and
+// rejects every other request without the current one.
+type fakeSessionServer struct {
+	mu     sync.Mutex
+	token  string
+	logins int
+}
+
+func (f *fakeSessionServer) rotate() {
+	f.mu.Lock()
+	f.token = ""
+	f.mu.Unlock()
+}
+
+func (f *fakeSessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/control/login" {
+		var creds struct{ Name, Password string }
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&creds) != nil ||
+			creds.Name != "admin" || creds.Password != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.logins++
+		f.token = "session-" + strconv.Itoa(f.logins)
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: f.token})
+		return
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || f.token == "" || c.Value != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Write([]byte(`{"num_dns_queries": 7}`))
+}
+
+func TestCookieAuth(t *testing.T) {
+	fake := &fakeSessionServer{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("ADGUARD_PASS", "secret")
+
+	var stats AdGuardStats
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err == nil {
+		t.Errorf("Expected basic auth to be rejected")
+	}
+
+	t.Setenv("ADGUARD_AUTH_MODE", "cookie")
+	for i := 0; i < 2; i++ {
+		if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err != nil {
+			t.Fatalf("fetchJSON with cookie auth failed: %v", err)
+		}
+	}
+	if stats.NumDNSQueries != 7 {
+		t.Errorf("Expected 7 DNS queries, got %v", stats.NumDNSQueries)
+	}
+	if fake.logins != 1 {
+		t.Errorf("Expected the session to be reused, got %d logins", fake.logins)
+	}
+
+	fake.rotate()
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err != nil {
+		t.Fatalf("Expected a rejected session to be renewed, got %v", err)
+	}
+	if fake.logins != 2 {
+		t.Errorf("Expected a second login after the session was rejected, got %d", fake.logins)
+	}
+}
+
+func TestCookieAuthBadCredentials(t *testing.T) {
+	srv := httptest.NewServer(&fakeSessionServer{})
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_AUTH_MODE", "cookie")
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("ADGUARD_PASS", "wrong")
+
+	var stats AdGuardStats
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err == nil {
+		t.Errorf("Expected a failed session login to be reported")
+	}
+}
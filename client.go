@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Client talks to one AdGuard Home instance. NewClient resolves its
+// credentials once, so requests neither re-parse the environment nor re-read
+// *_FILE secrets; reloadClients builds fresh clients on SIGHUP.
+type Client struct {
+	// Host is the instance's base URL and the value of its instance label.
+	Host string
+
+	creds map[string]credential
+	http  *http.Client
+}
+
+type credential struct {
+	user, pass string
+}
+
+// endpointCredentials are the endpoints with their own documented credential
+// overrides, e.g. STATS_USER/STATS_PASS. Other endpoints never read a
+// <ENDPOINT>_USER variable, so an unrelated env var can't leak into a request.
+var endpointCredentials = map[string]bool{"stats": true, "status": true, "querylog": true, "replica": true}
+
+// NewClient returns the client for t. The instance's own credentials from
+// ADGUARD_HOSTS take precedence over the per-endpoint overrides, then
+// ADGUARD_USER/ADGUARD_PASS.
+func NewClient(t target) *Client {
+	global := credential{envOrFile("ADGUARD_USER"), envOrFile("ADGUARD_PASS")}
+	resolve := func(prefix string) credential {
+		c := credential{t.User, t.Pass}
+		if prefix != "" && c.user == "" {
+			c.user = envOrFile(prefix + "_USER")
+		}
+		if prefix != "" && c.pass == "" {
+			c.pass = envOrFile(prefix + "_PASS")
+		}
+		if c.user == "" {
+			c.user = global.user
+		}
+		if c.pass == "" {
+			c.pass = global.pass
+		}
+		return c
+	}
+
+	c := &Client{Host: t.Host, http: httpClient, creds: map[string]credential{"": resolve("")}}
+	for endpoint := range endpointCredentials {
+		c.creds[endpoint] = resolve(strings.ToUpper(endpoint))
+	}
+	return c
+}
+
+// credentials returns the user and password for requests to endpoint.
+func (c *Client) credentials(endpoint string) (string, string) {
+	cred, ok := c.creds[endpoint]
+	if !ok {
+		cred = c.creds[""]
+	}
+	return cred.user, cred.pass
+}
+
+// clientSet is what a scrape talks to: a client per configured instance and
+// one for ADGUARD_REPLICA_HOST, if set.
+type clientSet struct {
+	instances []*Client
+	replica   *Client
+}
+
+var adguardClients atomic.Pointer[clientSet]
+
+// reloadClients builds the clients from the current settings and makes them
+// the ones the next scrape uses.
+func reloadClients() *clientSet {
+	set := &clientSet{}
+	for _, t := range targets() {
+		set.instances = append(set.instances, NewClient(t))
+	}
+	if host := os.Getenv("ADGUARD_REPLICA_HOST"); host != "" {
+		set.replica = NewClient(target{Host: normalizeHost(host)})
+	}
+	adguardClients.Store(set)
+	return set
+}
+
+// currentClients returns the clients built by the last reloadClients.
+func currentClients() *clientSet {
+	if set := adguardClients.Load(); set != nil {
+		return set
+	}
+	return reloadClients()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientEndpoints(t *testing.T) {
+	var paths []string
+	record := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.Write([]byte(body))
+		}
+	}
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats":    record(`{"num_dns_queries":1000}`),
+		"/control/status":   record(`{"protection_enabled":true}`),
+		"/control/querylog": record(`{"data":[{"time":"2024-01-01T00:00:00Z","question":{"name":"example.com","type":"A"}}]}`),
+	})
+	c := NewClient(target{Host: srv.URL})
+
+	stats, err := c.Stats(context.Background())
+	if err != nil || stats.NumDNSQueries != 1000 {
+		t.Errorf("Expected 1000 queries from Stats, got %+v (%v)", stats, err)
+	}
+	status, err := c.Status(context.Background())
+	if err != nil || !status.ProtectionEnabled {
+		t.Errorf("Expected protection enabled from Status, got %+v (%v)", status, err)
+	}
+	logData, err := c.QueryLog(context.Background())
+	if err != nil || len(logData.Data) != 1 {
+		t.Errorf("Expected one querylog entry from QueryLog, got %+v (%v)", logData, err)
+	}
+	want := []string{"/control/stats", "/control/status", "/control/querylog"}
+	if len(paths) != len(want) {
+		t.Fatalf("Expected requests to %v, got %v", want, paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Errorf("Expected request %d to %s, got %s", i, want[i], paths[i])
+		}
+	}
+}
+
+func TestClientResolvesCredentialsOnce(t *testing.T) {
+	var pass string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pass, _ = r.BasicAuth()
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	passFile := filepath.Join(t.TempDir(), "pass")
+	os.WriteFile(passFile, []byte("old\n"), 0o600)
+	clearEnv(t, "ADGUARD_HOSTS", "ADGUARD_PASS", "ADGUARD_REPLICA_HOST")
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("ADGUARD_PASS_FILE", passFile)
+
+	c := reloadClients().instances[0]
+	os.WriteFile(passFile, []byte("new\n"), 0o600)
+	if _, err := c.Stats(context.Background()); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if pass != "old" {
+		t.Errorf("Expected the password read when the client was built, got %q", pass)
+	}
+
+	if _, err := reloadClients().instances[0].Stats(context.Background()); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if pass != "new" {
+		t.Errorf("Expected reloaded clients to pick up the rotated password, got %q", pass)
+	}
+}
+
+func TestReloadConfigRebuildsClients(t *testing.T) {
+	defer func(l int32, j bool) { currentLogLevel.Store(l); logJSON.Store(j) }(currentLogLevel.Load(), logJSON.Load())
+	clearEnv(t, "CONFIG_FILE", "ADGUARD_HOST", "ADGUARD_HOSTS", "ADGUARD_USER", "ADGUARD_PASS", "ADGUARD_REPLICA_HOST", "ADGUARD_AUTH_MODE")
+	t.Setenv("ADGUARD_HOST", "http://a:3000")
+	if got := reloadClients().instances[0].Host; got != "http://a:3000" {
+		t.Fatalf("Expected a client for ADGUARD_HOST, got %s", got)
+	}
+
+	path := writeConfig(t, "hosts: http://b:3000,http://c:3000\nuser: admin\npass: secret\n")
+	t.Setenv("CONFIG_FILE", path)
+	reloadConfig()
+	set := currentClients()
+	if len(set.instances) != 2 || set.instances[0].Host != "http://b:3000" || set.instances[1].Host != "http://c:3000" {
+		t.Fatalf("Expected clients for the reloaded hosts, got %+v", set.instances)
+	}
+	if user, pass := set.instances[1].credentials("stats"); user != "admin" || pass != "secret" {
+		t.Errorf("Expected the reloaded credentials, got %s/%s", user, pass)
+	}
+
+	if err := os.WriteFile(path, []byte("hosts: not a url\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	if got := currentClients(); got != set {
+		t.Errorf("Expected invalid settings to keep the current clients, got %+v", got.instances)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clientNameTTL is how long an instance's /control/clients response is reused
+// before the next scrape fetches it again (CLIENT_NAME_TTL).
+var clientNameTTL = 5 * time.Minute
+
+type clientNameEntry struct {
+	names   map[string]string
+	fetched time.Time
+}
+
+// clientNames caches the IP→name mapping per instance.
+var clientNames = struct {
+	sync.Mutex
+	byInstance map[string]clientNameEntry
+}{byInstance: map[string]clientNameEntry{}}
+
+// clientNameMap maps every ID of the persistent clients and every runtime
+// client's IP to its name. Persistent clients win, as they are named by hand.
+func clientNameMap(clients *AdGuardClients) map[string]string {
+	names := map[string]string{}
+	for _, c := range clients.AutoClients {
+		if c.Name != "" {
+			names[c.IP] = c.Name
+		}
+	}
+	for _, c := range clients.Clients {
+		for _, id := range c.IDs {
+			names[id] = c.Name
+		}
+	}
+	return names
+}
+
+// clientNamesFresh reports whether instance's clients were fetched within
+// clientNameTTL, so the scrape can skip /control/clients.
+func clientNamesFresh(instance string) bool {
+	clientNames.Lock()
+	defer clientNames.Unlock()
+	entry, ok := clientNames.byInstance[instance]
+	return ok && time.Since(entry.fetched) <= clientNameTTL
+}
+
+// rememberClientNames caches the IP→name mapping of clients for instance. A
+// nil clients records a failed fetch, so an instance without the clients API
+// isn't asked again until the TTL expires.
+func rememberClientNames(instance string, clients *AdGuardClients) {
+	names := map[string]string{}
+	if clients != nil {
+		names = clientNameMap(clients)
+	}
+	clientNames.Lock()
+	defer clientNames.Unlock()
+	clientNames.byInstance[instance] = clientNameEntry{names: names, fetched: time.Now()}
+}
+
+// clientName returns the name AdGuard knows client by on instance, or client
+// itself when it has none or the clients haven't been fetched yet.
+func clientName(instance, client string) string {
+	clientNames.Lock()
+	defer clientNames.Unlock()
+	if name, ok := clientNames.byInstance[instance].names[client]; ok {
+		return name
+	}
+	return client
+}
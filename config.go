@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of CONFIG_FILE. Each key fills in the environment
+// variable named in its comment; env holds any other variable by name.
+type fileConfig struct {
+	Host           string            `yaml:"host"`            // ADGUARD_HOST
+	Hosts          string            `yaml:"hosts"`           // ADGUARD_HOSTS
+	User           string            `yaml:"user"`            // ADGUARD_USER
+	Pass           string            `yaml:"pass"`            // ADGUARD_PASS
+	AuthMode       string            `yaml:"auth_mode"`       // ADGUARD_AUTH_MODE
+	Port           string            `yaml:"port"`            // EXPORTER_PORT
+	ScrapeInterval string            `yaml:"scrape_interval"` // SCRAPE_INTERVAL
+	LogLevel       string            `yaml:"log_level"`       // LOG_LEVEL
+	LogFormat      string            `yaml:"log_format"`      // LOG_FORMAT
+	Env            map[string]string `yaml:"env"`
+}
+
+func (c *fileConfig) vars() map[string]string {
+	vars := map[string]string{}
+	for name, value := range c.Env {
+		vars[name] = value
+	}
+	for name, value := range map[string]string{
+		"ADGUARD_HOST": c.Host, "ADGUARD_HOSTS": c.Hosts,
+		"ADGUARD_USER": c.User, "ADGUARD_PASS": c.Pass, "ADGUARD_AUTH_MODE": c.AuthMode,
+		"EXPORTER_PORT": c.Port, "SCRAPE_INTERVAL": c.ScrapeInterval,
+		"LOG_LEVEL": c.LogLevel, "LOG_FORMAT": c.LogFormat,
+	} {
+		if value != "" {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// configSources records where each variable set by CONFIG_FILE came from:
+// "env" when the environment overrode the file, "CONFIG_FILE" otherwise.
+var configSources = map[string]string{}
+
+// configFileErr is the error from loading CONFIG_FILE, reported by main.
+var configFileErr error
+
+// loadStartupEnv reads .env and CONFIG_FILE into the environment once, before
+// the first setting is read. Like .env, the file never overrides a variable
+// that is already set.
+var loadStartupEnv = sync.OnceFunc(func() {
+	_ = godotenv.Load()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		configFileErr = applyConfigFile(path)
+	}
+})
+
+// readConfigFile parses the YAML file at path, rejecting unknown keys.
+func readConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// applyConfigFile sets the variables from the YAML file at path that the
+// environment leaves empty, then checks the merged settings.
+func applyConfigFile(path string) error {
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range cfg.vars() {
+		if os.Getenv(name) != "" {
+			configSources[name] = "env"
+			continue
+		}
+		os.Setenv(name, value)
+		configSources[name] = "CONFIG_FILE"
+	}
+
+	if os.Getenv("ADGUARD_HOST") == "" && os.Getenv("ADGUARD_HOSTS") == "" {
+		return fmt.Errorf("%s: host (or ADGUARD_HOST) is required", path)
+	}
+	for _, name := range []string{"EXPORTER_PORT", "SCRAPE_INTERVAL"} {
+		if raw := os.Getenv(name); raw != "" {
+			if n, err := strconv.Atoi(raw); err != nil || n < 1 {
+				return fmt.Errorf("%s: %s must be a positive integer, got %q", path, name, raw)
+			}
+		}
+	}
+	return nil
+}
+
+// logConfigSources logs at DEBUG where each CONFIG_FILE setting came from.
+func logConfigSources() {
+	for _, name := range sortedKeys(configSources) {
+		logKV("DEBUG", "Config setting", "name", name, "source", configSources[name])
+	}
+}
+
+// validateConfig checks the settings every scrape depends on, so a
+// misconfigured exporter exits at startup instead of failing each scrape: every
+// instance needs an absolute http(s) URL, and credentials when AdGuard expects
+// them. Cookie auth always logs in; basic auth needs both user and password or
+// neither.
+func validateConfig() error {
+	list := targets()
+	if len(list) == 0 {
+		return errors.New("no AdGuard instance configured, set ADGUARD_HOST or ADGUARD_HOSTS")
+	}
+	for _, t := range list {
+		if t.Host == "" {
+			return errors.New("ADGUARD_HOST is required")
+		}
+		u, err := url.Parse(t.Host)
+		if err != nil {
+			return fmt.Errorf("invalid AdGuard host %q: %w", t.Host, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid AdGuard host %q: expected a URL like http://192.168.1.1:3000", t.Host)
+		}
+
+		user, pass := NewClient(t).credentials("status")
+		switch mode := authMode(); {
+		case mode == "none":
+		case mode == "cookie" && (user == "" || pass == ""):
+			return fmt.Errorf("%s: ADGUARD_AUTH_MODE=cookie needs ADGUARD_USER and ADGUARD_PASS", t.Host)
+		case (user == "") != (pass == ""):
+			return fmt.Errorf("%s: set both ADGUARD_USER and ADGUARD_PASS, or neither for AdGuard without authentication", t.Host)
+		}
+	}
+	return nil
+}
+
+// reloadableVars are the settings a running exporter picks up on SIGHUP.
+// Everything else is read once at startup.
+var reloadableVars = []string{
+	"LOG_LEVEL", "LOG_FORMAT",
+	"ADGUARD_HOST", "ADGUARD_HOSTS", "ADGUARD_USERS", "ADGUARD_PASSES",
+	"ADGUARD_USER", "ADGUARD_PASS", "ADGUARD_REPLICA_HOST",
+}
+
+// reloadConfig re-reads the reloadable settings from .env and CONFIG_FILE,
+// which wins, and applies them. Unlike at startup, a value from either file
+// replaces the environment's, since the environment of a running process
+// can't be changed. The AdGuard clients are rebuilt, which also re-reads
+// *_FILE secrets, unless the new settings are invalid.
+func reloadConfig() {
+	values, err := godotenv.Read()
+	if err != nil {
+		values = map[string]string{}
+	}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		cfg, err := readConfigFile(path)
+		if err != nil {
+			logX("WARN", "Failed to reload CONFIG_FILE, keeping the current settings: %v", err)
+			return
+		}
+		for name, value := range cfg.vars() {
+			values[name] = value
+		}
+	}
+	for _, name := range reloadableVars {
+		if value, ok := values[name]; ok {
+			os.Setenv(name, value)
+		}
+	}
+	initLogger()
+	if err := validateConfig(); err != nil {
+		logX("WARN", "Keeping the current AdGuard clients, the reloaded settings are invalid: %v", err)
+	} else {
+		reloadClients()
+	}
+	logX("INFO", "Reloaded configuration: LOG_LEVEL=%s LOG_FORMAT=%s instances=%d",
+		os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"), len(currentClients().instances))
+}
+
+// runReloader calls reloadConfig for every signal received on hup until ctx
+// is cancelled.
+func runReloader(ctx context.Context, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reloadConfig()
+		}
+	}
+}
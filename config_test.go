@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// clearEnv unsets names for the rest of the test, restoring them afterwards.
+func clearEnv(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	clearEnv(t, "ADGUARD_HOST", "ADGUARD_HOSTS", "ADGUARD_USER", "ADGUARD_PASS", "EXPORTER_PORT", "SCRAPE_INTERVAL", "QUERYLOG_LIMIT")
+	t.Setenv("ADGUARD_USER", "from-env")
+	path := writeConfig(t, `
+host: http://192.168.1.1:3000
+user: from-file
+pass: secret
+port: 9200
+scrape_interval: 30
+env:
+  QUERYLOG_LIMIT: "1000"
+`)
+
+	if err := applyConfigFile(path); err != nil {
+		t.Fatalf("Failed to apply config file: %v", err)
+	}
+	for name, want := range map[string]string{
+		"ADGUARD_HOST":    "http://192.168.1.1:3000",
+		"ADGUARD_USER":    "from-env",
+		"ADGUARD_PASS":    "secret",
+		"EXPORTER_PORT":   "9200",
+		"SCRAPE_INTERVAL": "30",
+		"QUERYLOG_LIMIT":  "1000",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("Expected %s=%q, got %q", name, want, got)
+		}
+	}
+	if configSources["ADGUARD_USER"] != "env" || configSources["ADGUARD_PASS"] != "CONFIG_FILE" {
+		t.Errorf("Unexpected config sources %v", configSources)
+	}
+}
+
+func TestApplyConfigFileValidation(t *testing.T) {
+	cases := map[string]string{
+		"missing host":     "user: admin\n",
+		"unknown key":      "host: http://a:3000\nhots: typo\n",
+		"invalid interval": "host: http://a:3000\nscrape_interval: soon\n",
+		"malformed":        "host: [\n",
+	}
+	for name, body := range cases {
+		clearEnv(t, "ADGUARD_HOST", "ADGUARD_HOSTS", "SCRAPE_INTERVAL")
+		if err := applyConfigFile(writeConfig(t, body)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	clearEnv(t, "ADGUARD_HOST", "ADGUARD_HOSTS")
+	if err := applyConfigFile(filepath.Join(t.TempDir(), "missing.yml")); err == nil || !strings.Contains(err.Error(), "missing.yml") {
+		t.Errorf("Expected an error naming the missing file, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	clearEnv(t, "ADGUARD_HOSTS", "ADGUARD_USER", "ADGUARD_PASS", "STATUS_USER", "STATUS_PASS", "ADGUARD_AUTH_MODE")
+	cases := []struct {
+		host, user, pass, mode string
+		valid                  bool
+	}{
+		{"", "", "", "", false},
+		{"192.168.1.1:3000", "", "", "", true},
+		{"ftp://192.168.1.1", "", "", "", false},
+		{"http://", "", "", "", false},
+		{"http://[::1", "", "", "", false},
+		{"http://192.168.1.1:3000", "", "", "", true},
+		{"https://adguard.example.com", "admin", "secret", "", true},
+		{"http://192.168.1.1:3000", "admin", "", "", false},
+		{"http://192.168.1.1:3000", "", "", "cookie", false},
+		{"http://192.168.1.1:3000", "admin", "", "none", true},
+	}
+	for _, tc := range cases {
+		t.Setenv("ADGUARD_HOST", tc.host)
+		t.Setenv("ADGUARD_USER", tc.user)
+		t.Setenv("ADGUARD_PASS", tc.pass)
+		t.Setenv("ADGUARD_AUTH_MODE", tc.mode)
+		if err := validateConfig(); (err == nil) != tc.valid {
+			t.Errorf("host=%q user=%q pass=%q mode=%q: expected valid=%v, got %v", tc.host, tc.user, tc.pass, tc.mode, tc.valid, err)
+		}
+	}
+}
+
+func TestReloadLogLevelOnSIGHUP(t *testing.T) {
+	defer func(l int32, j bool) { currentLogLevel.Store(l); logJSON.Store(j) }(currentLogLevel.Load(), logJSON.Load())
+	clearEnv(t, "CONFIG_FILE", "LOG_LEVEL", "LOG_FORMAT")
+	t.Setenv("LOG_LEVEL", "INFO")
+	initLogger()
+
+	path := writeConfig(t, "host: http://a:3000\nlog_level: DEBUG\nlog_format: json\n")
+	t.Setenv("CONFIG_FILE", path)
+	ctx, cancel := context.WithCancel(context.Background())
+	hup := make(chan os.Signal)
+	stopped := make(chan struct{})
+	go func() {
+		runReloader(ctx, hup)
+		close(stopped)
+	}()
+
+	hup <- syscall.SIGHUP
+	hup <- syscall.SIGHUP // returns once the first reload has finished
+	cancel()
+	<-stopped // the second reload must not outlive the restored settings
+	if got := currentLogLevel.Load(); got != logLevelMap["DEBUG"] {
+		t.Errorf("Expected LOG_LEVEL DEBUG after SIGHUP, got %d", got)
+	}
+	if !logJSON.Load() {
+		t.Errorf("Expected LOG_FORMAT json after SIGHUP")
+	}
+
+	if err := os.WriteFile(path, []byte("log_level: [\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloadConfig()
+	if got := currentLogLevel.Load(); got != logLevelMap["DEBUG"] {
+		t.Errorf("Expected a broken CONFIG_FILE to keep the current level, got %d", got)
+	}
+}
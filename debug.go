@@ -0,0 +1,176 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// debugRow is a single series rendered on the /debug/metrics page.
+type debugRow struct {
+	Name      string
+	Labels    string
+	Value     string
+	Timestamp string
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>AdGuard Exporter - Metrics</title></head>
+<body>
+<h1>AdGuard Exporter metrics</h1>
+<p>Gathered at {{.GatheredAt}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Metric</th><th>Labels</th><th>Value</th><th>Timestamp</th></tr>
+{{range .Rows}}<tr><td>{{.Name}}</td><td>{{.Labels}}</td><td>{{.Value}}</td><td>{{.Timestamp}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// debugMetricsHandler renders every metric from g as an HTML table. It only
+// shows what /metrics already exposes, so no credentials can leak through it.
+func debugMetricsHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		families, err := g.Gather()
+		if err != nil {
+			logX("WARN", "Failed to gather metrics for debug page: %v", err)
+		}
+
+		var rows []debugRow
+		for _, mf := range families {
+			for _, m := range mf.GetMetric() {
+				row := debugRow{Name: mf.GetName(), Labels: formatLabels(m), Value: formatValue(mf.GetType(), m)}
+				if m.TimestampMs != nil {
+					row.Timestamp = time.UnixMilli(m.GetTimestampMs()).UTC().Format(time.RFC3339)
+				}
+				rows = append(rows, row)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = debugTemplate.Execute(w, struct {
+			GatheredAt string
+			Rows       []debugRow
+		}{time.Now().UTC().Format(time.RFC3339), rows})
+		if err != nil {
+			logX("WARN", "Failed to render debug page: %v", err)
+		}
+	})
+}
+
+func formatLabels(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		pairs = append(pairs, lp.GetName()+`="`+lp.GetValue()+`"`)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func formatValue(t dto.MetricType, m *dto.Metric) string {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return formatFloat(m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		return formatFloat(m.GetGauge().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		return "count=" + strconv.FormatUint(h.GetSampleCount(), 10) + " sum=" + formatFloat(h.GetSampleSum())
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		return "count=" + strconv.FormatUint(s.GetSampleCount(), 10) + " sum=" + formatFloat(s.GetSampleSum())
+	default:
+		return formatFloat(m.GetUntyped().GetValue())
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sumValue adds up the current values of all gauge series of c.
+func sumValue(c prometheus.Collector) float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var sum float64
+	for m := range ch {
+		var d dto.Metric
+		if err := m.Write(&d); err == nil {
+			sum += d.GetGauge().GetValue()
+		}
+	}
+	return sum
+}
+
+// sumByInstance adds up the current values of the gauge or counter series of
+// c per instance label.
+func sumByInstance(c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	sums := map[string]float64{}
+	for m := range ch {
+		var d dto.Metric
+		if err := m.Write(&d); err != nil {
+			continue
+		}
+		for _, lp := range d.GetLabel() {
+			if lp.GetName() == "instance" {
+				sums[lp.GetValue()] += d.GetGauge().GetValue() + d.GetCounter().GetValue()
+			}
+		}
+	}
+	return sums
+}
+
+// metricsSummary is a compact one-line view of the key metrics: the query
+// totals summed across instances, then adguard_up and scrape_errors_total for
+// each instance.
+func metricsSummary() string {
+	summary := "queries=" + formatFloat(sumValue(dnsQueries)) +
+		" blocked=" + formatFloat(sumValue(blockedAll))
+	up, errs := sumByInstance(adguardUp), sumByInstance(scrapeErrors)
+	instances := make([]string, 0, len(up))
+	for instance := range up {
+		instances = append(instances, instance)
+	}
+	for instance := range errs {
+		if _, ok := up[instance]; !ok {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		summary += " instance=" + instance +
+			" up=" + formatFloat(up[instance]) +
+			" scrape_errors=" + formatFloat(errs[instance])
+	}
+	return summary
+}
+
+// runDebugDump logs metricsSummary at INFO every interval until done is closed
+// (DEBUG_DUMP_INTERVAL).
+func runDebugDump(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logX("INFO", "Metrics summary: %s", metricsSummary())
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDebugMetricsHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "adguard_test_gauge", Help: "test"})
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "adguard_test_total", Help: "test"}, []string{"domain"})
+	reg.MustRegister(g, v)
+	g.Set(42)
+	v.WithLabelValues("example.com").Add(3)
+
+	rec := httptest.NewRecorder()
+	debugMetricsHandler(reg).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/metrics", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"<td>adguard_test_gauge</td><td></td><td>42</td>",
+		"<td>adguard_test_total</td><td>domain=&#34;example.com&#34;</td><td>3</td>",
+		"Gathered at",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected debug page to contain %q, got:\n%s", want, body)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+}
+
+func TestRunDebugDumpLogsSummary(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	dnsQueries.WithLabelValues("debug-dump").Set(1234)
+	adguardUp.WithLabelValues("debug-dump").Set(1)
+	scrapeErrors.WithLabelValues("debug-dump", "stats").Add(2)
+	scrapeErrors.WithLabelValues("debug-dump", "status").Inc()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		runDebugDump(10*time.Millisecond, done)
+		close(finished)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	<-finished
+
+	out := buf.String()
+	if !strings.Contains(out, "[INFO] Metrics summary:") || !strings.Contains(out, "queries=1234") {
+		t.Errorf("Expected a metrics summary log line, got %q", out)
+	}
+	if !strings.Contains(out, "instance=debug-dump up=1 scrape_errors=3") {
+		t.Errorf("Expected adguard_up and scrape_errors_total for the instance, got %q", out)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// parseExtraLabels parses EXTRA_LABELS, e.g. "site=home,region=eu", into the
+// constant labels added to every exporter metric. Malformed pairs, invalid
+// label names and repeated names are skipped with a warning.
+func parseExtraLabels(raw string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case !ok || value == "" || !validLabelName(name):
+			logX("WARN", "Ignoring invalid EXTRA_LABELS entry %q, expected name=value", pair)
+		case labels[name] != "":
+			logX("WARN", "Ignoring repeated EXTRA_LABELS name %q", name)
+		default:
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// validLabelName reports whether name is a Prometheus label name that isn't
+// reserved for internal use.
+func validLabelName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") {
+		return false
+	}
+	for i, r := range name {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutClashes drops, with a warning, the labels that one of collectors
+// already uses, such as instance, since registering it would fail.
+func withoutClashes(labels prometheus.Labels, collectors []prometheus.Collector) prometheus.Labels {
+	kept := prometheus.Labels{}
+	for name, value := range labels {
+		reg := prometheus.WrapRegistererWith(prometheus.Labels{name: value}, prometheus.NewRegistry())
+		clash := false
+		for _, c := range collectors {
+			if err := reg.Register(c); err != nil {
+				clash = true
+				break
+			}
+		}
+		if clash {
+			logX("WARN", "Ignoring EXTRA_LABELS name %q, which the exporter's metrics already use", name)
+			continue
+		}
+		kept[name] = value
+	}
+	return kept
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseExtraLabels(t *testing.T) {
+	got := parseExtraLabels(" site=home, region = eu ,broken,=x,empty=,9lives=1,__meta=x,site=office,")
+	want := prometheus.Labels{"site": "home", "region": "eu"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if got := parseExtraLabels(""); len(got) != 0 {
+		t.Errorf("Expected no labels when unset, got %v", got)
+	}
+}
+
+func TestWithoutClashes(t *testing.T) {
+	got := withoutClashes(prometheus.Labels{"site": "home", "instance": "x"}, []prometheus.Collector{dnsQueries})
+	if want := (prometheus.Labels{"site": "home"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the clashing instance label to be dropped, got %v", got)
+	}
+}
+
+// TestExtraLabels re-runs itself with EXTRA_LABELS set, since the labels are
+// applied when the metrics are registered at package initialisation.
+func TestExtraLabels(t *testing.T) {
+	if os.Getenv("EXTRA_LABELS") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExtraLabels$")
+		cmd.Env = append(os.Environ(), "EXTRA_LABELS=site=home,region=eu,instance=clash")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Run with EXTRA_LABELS failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	dnsQueries.WithLabelValues("extra").Set(1)
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	seen := 0
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "adguard_") {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			seen++
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["site"] != "home" || labels["region"] != "eu" || labels["instance"] == "clash" {
+				t.Errorf("%s: expected site=home and region=eu, got %v", mf.GetName(), labels)
+			}
+		}
+	}
+	if seen == 0 {
+		t.Fatal("Expected adguard_ metrics to be gathered")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// logicalFields maps the names accepted in FIELD_MAP to the standard AdGuard
+// JSON keys the exporter decodes.
+var logicalFields = map[string]string{
+	"queries":             "num_dns_queries",
+	"blocked":             "num_blocked_filtering",
+	"parental":            "num_replaced_parental",
+	"safebrowsing":        "num_replaced_safebrowsing",
+	"safesearch":          "num_replaced_safesearch",
+	"avg_processing_time": "avg_processing_time",
+	"top_queried":         "top_queried_domains",
+	"top_blocked":         "top_blocked_domains",
+	"top_clients":         "top_clients",
+	"top_upstreams":       "top_upstreams_responses",
+	"top_upstreams_time":  "top_upstreams_avg_time",
+	"version":             "version",
+	"running":             "running",
+	"protection_enabled":  "protection_enabled",
+	"querylog":            "data",
+}
+
+// fieldMap maps standard JSON keys to the keys a fork actually uses.
+var fieldMap map[string]string
+
+// parseFieldMap parses FIELD_MAP, e.g. "queries=dns_queries,blocked=blocked_count".
+// Unknown logical fields and malformed pairs are skipped with a warning.
+func parseFieldMap(raw string) map[string]string {
+	m := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		logical, key, ok := strings.Cut(pair, "=")
+		std, known := logicalFields[strings.TrimSpace(logical)]
+		if !ok || !known || strings.TrimSpace(key) == "" {
+			logX("WARN", "Ignoring invalid FIELD_MAP entry %q", pair)
+			continue
+		}
+		m[std] = strings.TrimSpace(key)
+	}
+	return m
+}
+
+// decodeJSON unmarshals body into v, first renaming any fork-specific keys from
+// fieldMap back to their standard names. Unmapped fields decode as usual, and
+// bodies that aren't JSON objects, such as the rewrite list, aren't remapped.
+func decodeJSON(body []byte, v interface{}) error {
+	if len(fieldMap) == 0 || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return json.Unmarshal(body, v)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	for std, key := range fieldMap {
+		if val, ok := raw[key]; ok {
+			raw[std] = val
+		}
+	}
+	remapped, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(remapped, v)
+}
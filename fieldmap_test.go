@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeJSONWithFieldMap(t *testing.T) {
+	defer func(m map[string]string) { fieldMap = m }(fieldMap)
+	fieldMap = parseFieldMap("queries=dns_queries_count, blocked=blocked_count,bogus=x,version")
+
+	payload := `{"dns_queries_count":500,"blocked_count":42,"num_replaced_parental":3,"avg_processing_time":1.5}`
+	var stats AdGuardStats
+	if err := decodeJSON([]byte(payload), &stats); err != nil {
+		t.Fatalf("decodeJSON failed: %v", err)
+	}
+
+	if stats.NumDNSQueries != 500 || stats.NumBlockedFiltering != 42 {
+		t.Errorf("Mapped fields not decoded: queries=%v blocked=%v", stats.NumDNSQueries, stats.NumBlockedFiltering)
+	}
+	if stats.NumReplacedParental != 3 || stats.AvgProcessingTime != 1.5 {
+		t.Errorf("Unmapped fields should fall back to standard keys: parental=%v avg=%v",
+			stats.NumReplacedParental, stats.AvgProcessingTime)
+	}
+	if len(fieldMap) != 2 {
+		t.Errorf("Expected invalid entries to be skipped, got %v", fieldMap)
+	}
+}
+
+func TestDecodeJSONArrayWithFieldMap(t *testing.T) {
+	defer func(m map[string]string) { fieldMap = m }(fieldMap)
+	fieldMap = parseFieldMap("queries=dns_queries_count")
+
+	var rewrites []AdGuardRewrite
+	if err := decodeJSON([]byte(` [{"domain":"nas.lan","answer":"192.168.1.10"}]`), &rewrites); err != nil {
+		t.Fatalf("decodeJSON failed on an array: %v", err)
+	}
+	if want := []AdGuardRewrite{{Domain: "nas.lan", Answer: "192.168.1.10"}}; !reflect.DeepEqual(rewrites, want) {
+		t.Errorf("Expected %v, got %v", want, rewrites)
+	}
+
+	var ids []string
+	if err := decodeJSON([]byte(`["youtube","tiktok"]`), &ids); err != nil || len(ids) != 2 {
+		t.Errorf("Expected the blocked services list to decode, got %v (%v)", ids, err)
+	}
+}
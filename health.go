@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// ready is set once an update cycle has succeeded for every instance, so
+// /readyz keeps a freshly started exporter out of rotation until its metrics
+// hold real values.
+var ready atomic.Bool
+
+// healthzHandler answers liveness probes: the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler answers readiness probes with 503 while a startup login is
+// still running and until the first successful scrape. With
+// SCRAPE_MODE=ondemand that is the first /metrics request.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if loginPending("") {
+		http.Error(w, "waiting for AdGuard login", http.StatusServiceUnavailable)
+		return
+	}
+	if !ready.Load() {
+		http.Error(w, "no successful scrape yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
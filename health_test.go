@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	ready.Store(false)
+	probe := func(h http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	if code := probe(healthzHandler); code != http.StatusOK {
+		t.Errorf("Expected /healthz 200 before any scrape, got %d", code)
+	}
+	if code := probe(readyzHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 before any scrape, got %d", code)
+	}
+
+	newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	})
+	updateMetrics(context.Background())
+	if code := probe(readyzHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 after a failed scrape, got %d", code)
+	}
+
+	newFakeAdGuard(t, nil)
+	updateMetrics(context.Background())
+	if code := probe(readyzHandler); code != http.StatusOK {
+		t.Errorf("Expected /readyz 200 after a successful scrape, got %d", code)
+	}
+	if code := probe(healthzHandler); code != http.StatusOK {
+		t.Errorf("Expected /healthz 200 after a scrape, got %d", code)
+	}
+}
+
+func TestStartupLoginDoesNotBlockServing(t *testing.T) {
+	defer ready.Store(ready.Load())
+	ready.Store(true)
+	var statsRequests atomic.Int32
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+		"/control/stats": func(w http.ResponseWriter, r *http.Request) {
+			statsRequests.Add(1)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startLogins(ctx, []*Client{NewClient(target{Host: srv.URL})}, 5, time.Hour)
+	defer func() {
+		cancel()
+		for loginPending("") {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz 503 while the login is retried, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected /healthz 200 while the login is retried, got %d", rec.Code)
+	}
+
+	updateMetrics(context.Background())
+	if n := statsRequests.Load(); n != 0 {
+		t.Errorf("Expected the instance to be skipped until its login finishes, got %d stats requests", n)
+	}
+}
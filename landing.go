@@ -0,0 +1,73 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// reservedPaths are served by the exporter itself and can't be METRICS_PATH.
+var reservedPaths = map[string]bool{"/": true, "/healthz": true, "/readyz": true, "/debug/metrics": true}
+
+// metricsPath returns the path /metrics is served at (METRICS_PATH), adding
+// the leading slash if it is missing.
+func metricsPath(raw string) string {
+	path := strings.TrimSpace(raw)
+	if path == "" {
+		return defaultMetricsPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if reservedPaths[path] {
+		logX("WARN", "METRICS_PATH %q is reserved, using %s", raw, defaultMetricsPath)
+		return defaultMetricsPath
+	}
+	return path
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>AdGuard Exporter</title></head>
+<body>
+<h1>AdGuard Exporter</h1>
+<p>Version {{.Version}}</p>
+<ul>
+<li><a href="{{.MetricsPath}}">Metrics</a></li>
+<li><a href="healthz">Health</a></li>
+<li><a href="readyz">Readiness</a></li>
+</ul>
+</body>
+</html>
+`))
+
+// landingHandler serves the page at / linking to the metrics. Any other
+// unregistered path is a 404 rather than the landing page.
+func landingHandler(metricsPath string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := landingTemplate.Execute(w, struct{ Version, MetricsPath string }{
+			version, strings.TrimPrefix(metricsPath, "/"),
+		})
+		if err != nil {
+			logX("WARN", "Failed to render landing page: %v", err)
+		}
+	})
+}
+
+// registerRoutes adds the exporter's endpoints to mux, serving metrics at
+// path. Links on the landing page are relative so it also works behind a
+// reverse proxy that strips a subpath. metrics is expected to be instrumented
+// by the caller; the other endpoints are instrumented here.
+func registerRoutes(mux *http.ServeMux, path string, metrics http.Handler) {
+	mux.Handle(path, metrics)
+	mux.Handle("/", instrumentHandler("/", landingHandler(path)))
+	mux.Handle("/healthz", instrumentHandler("/healthz", http.HandlerFunc(healthzHandler)))
+	mux.Handle("/readyz", instrumentHandler("/readyz", http.HandlerFunc(readyzHandler)))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsPath(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":               "/metrics",
+		"/metrics":       "/metrics",
+		"exporter/stats": "/exporter/stats",
+		"/adguard/prom":  "/adguard/prom",
+		"/healthz":       "/metrics",
+		"/":              "/metrics",
+	} {
+		if got := metricsPath(raw); got != want {
+			t.Errorf("METRICS_PATH=%q: expected %q, got %q", raw, want, got)
+		}
+	}
+}
+
+func TestCustomMetricsPathAndLandingPage(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux, "/adguard/prom", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("adguard_up 1\n"))
+	}))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := get("/adguard/prom"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "adguard_up") {
+		t.Errorf("Expected metrics at the custom path, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/metrics"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected /metrics to be a 404 with a custom path, got %d", rec.Code)
+	}
+	rec := get("/")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML landing page, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `href="adguard/prom"`) {
+		t.Errorf("Expected the landing page to link to the metrics, got %s", rec.Body.String())
+	}
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("Expected /healthz to be served, got %d", rec.Code)
+	}
+}
+
+func TestHealthzIsInstrumented(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux, "/metrics", http.NotFoundHandler())
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("/healthz", "200"))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected /healthz to be served, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("/healthz", "200")) - before; got != 1 {
+		t.Errorf("Expected adguard_exporter_http_requests_total{path=\"/healthz\"} to go up by 1, got %v", got)
+	}
+}
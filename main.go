@@ -1,18 +1,37 @@
 package main
 
 import (
-        "encoding/json"
-        "fmt"
-        "io"
-        "log"
-        "net/http"
-        "os"
-        "strconv"
-        "time"
-
-        "github.com/joho/godotenv"
-        "github.com/prometheus/client_golang/prometheus"
-        "github.com/prometheus/client_golang/prometheus/promhttp"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/publicsuffix"
 )
 
 /*
@@ -27,360 +46,2494 @@ import (
 
  Required ENV variables:
  - ADGUARD_HOST        : AdGuard Home base URL (e.g. http://192.168.1.1:3000)
+ - ADGUARD_BASE_PATH   : Path prefix AdGuard is served under behind a reverse proxy, e.g. /adguard (default: none)
  - ADGUARD_USER        : API username (your adguard user)
  - ADGUARD_PASS        : API password (your adguard pass)
+ - ADGUARD_HOSTS       : Optional comma-separated list of AdGuard instances to scrape instead of ADGUARD_HOST,
+                       paired by position with ADGUARD_USERS/ADGUARD_PASSES, or a JSON list of
+                       {"host","user","pass"} objects; every AdGuard metric carries an instance label
+ - CONFIG_FILE         : Optional YAML file (host, user, pass, port, scrape_interval, log_level, ..., env: {NAME: value});
+                       variables already set in the environment win over it
+ - ADGUARD_USER_FILE / ADGUARD_PASS_FILE : Read the credential from this file (Docker/Kubernetes secrets) when the
+                       plain variable is unset; also works for the per-endpoint and REPLICA_* credentials; re-read on SIGHUP
+ - ADGUARD_AUTH_MODE   : basic (default), cookie for an agh_session from /control/login, or none
+                       for AdGuard installs without authentication
  - EXPORTER_PORT       : Port to expose metrics (default: 9617)
- - SCRAPE_INTERVAL     : Interval (in seconds) to fetch new stats (default: 15)
+ - EXTRA_LABELS        : Comma-separated name=value labels added to every exporter metric, e.g. site=home,region=eu
+ - METRICS_PATH        : Path the metrics are served at; / serves a landing page linking to it (default: /metrics)
+ - SCRAPE_INTERVAL     : Interval (in seconds) to fetch new stats (default: 15; values under 5 log a WARN)
+ - SCRAPE_MODE         : interval (default) fetches every SCRAPE_INTERVAL; ondemand fetches on each /metrics request
+ - SCRAPE_TIMEOUT      : Seconds an ondemand /metrics request waits for AdGuard before serving the previous values (default: 10)
+ - LOG_FORMAT          : text (default) or json for one JSON object per line with level, msg, ts and fields
  - LOG_LEVEL           : Logging level (options: DEBUG, INFO, WARN, ERROR — default: INFO)
+                       LOG_LEVEL, LOG_FORMAT and the AdGuard hosts and credentials are re-read from .env and
+                       CONFIG_FILE on SIGHUP
+ - SCRAPE_SUCCESS_WINDOW : Number of recent scrapes used for adguard_scrape_success_ratio (default: 10)
+ - QUERYLOG_SEARCH     : Optional querylog search filter (domain or client substring)
+ - QUERYLOG_RESPONSE_STATUS : Optional querylog status filter (e.g. blocked, processed — default: all)
+ - STATS_USER/STATS_PASS, STATUS_USER/STATUS_PASS, QUERYLOG_USER/QUERYLOG_PASS :
+                       Optional per-endpoint credentials for instances without their own in ADGUARD_HOSTS,
+                       falling back to ADGUARD_USER/ADGUARD_PASS
+ - MAX_LABEL_VALUES    : Max distinct label values per capped metric (rewrite domains,
+                       clients, TLDs) before folding into "other" (default: 1000)
+ - QUERYLOG_LIMIT      : Entries per querylog page, sent as limit (default: AdGuard's page size)
+ - QUERYLOG_MAX_PAGES  : Max querylog pages to follow per scrape via older_than (default: 1); an aligned
+                       window it cuts short is finished by the following scrapes
+ - QUERYLOG_ALIGN_WINDOWS : Count querylog entries in non-overlapping windows aligned to SCRAPE_INTERVAL
+                       wall-clock boundaries (default: false)
+ - CLIENT_LAST_SEEN_TTL : Seconds a client may go unseen before its last-seen series is dropped (default: 86400)
+ - TOP_N_LIMIT         : Max entries of each AdGuard top list exported as series, highest first (default: 25, 0 = all)
+ - CLIENT_NAME_TTL     : Seconds between fetches of /control/clients for top-client names and client metrics (default: 300)
+ - UPSTREAM_NORMALIZE  : Group upstream labels by hostname, dropping protocol and port (default: false)
+ - MAX_LABEL_LENGTH    : Truncate domain/client/upstream label values to this many characters (default: 0, disabled)
+ - ADGUARD_HTTP_TIMEOUT : Timeout in seconds for each AdGuard API request (default: 10)
+ - ADGUARD_CA_FILE     : Optional PEM bundle trusted for AdGuard's HTTPS certificate (self-signed or internal CA)
+ - ADGUARD_TLS_SKIP_VERIFY : Don't verify AdGuard's HTTPS certificate; insecure, logged as a WARN (default: false)
+ - ADGUARD_PROXY_URL   : http://, https:// or socks5:// proxy for requests to AdGuard; without it
+                       HTTP_PROXY/HTTPS_PROXY/NO_PROXY apply
+ - ADGUARD_MAX_RETRIES : Retries with exponential backoff for an AdGuard request failing with a network
+                       error or 5xx status (default: 3)
+ - RETRY_BUDGET        : Max retries across all endpoints within one scrape cycle (default: 5)
+ - LOGIN_RETRIES       : Startup login attempts per instance while waiting for AdGuard to come up; they run
+                       in the background and the instance is scraped once they finish (default: 5)
+ - LOGIN_RETRY_INTERVAL : Initial delay in seconds between login attempts, doubled each retry (default: 2)
+ - API_LATENCY_BUCKETS : Comma-separated buckets (seconds) for adguard_api_request_duration_seconds
+ - QUERY_LATENCY_BUCKETS : Comma-separated buckets (ms) for the querylog latency histograms (default: 1,6,...,46)
+ - UPSTREAM_SLOW_THRESHOLD_MS : Elapsed time above which a forwarded query counts as slow in adguard_upstream_slow_total (default: 500)
+ - QUERYLOG_WORKERS    : Goroutines used to aggregate large querylogs (default: 1, serial)
+ - ENABLE_TLD_METRICS  : Count queries per top-level domain in adguard_query_tld_total (default: false)
+ - REASON_LABEL_ALLOWLIST : Comma-separated reason labels to keep; others become "other" (default: all known reasons)
+ - ENABLE_BLOCKED_ANSWER_INFO : Expose answers served for blocked queries (default: false)
+ - ENABLE_EXEMPLARS    : Attach client/upstream exemplars to the per-client latency histogram and serve OpenMetrics (default: false)
+ - ENABLE_QUERYLOG     : Fetch /control/querylog and expose the adguard_query_* and other querylog metrics (default: true)
+ - BLOCKED_ONLY_MODE   : Fetch only blocked querylog entries and update just the block-oriented metrics (default: false)
+ - ADGUARD_REPLICA_HOST : Optional replica paired with ADGUARD_HOST for adguard_replica_query_lag
+                       (credentials: REPLICA_USER/REPLICA_PASS, falling back to ADGUARD_USER/ADGUARD_PASS)
+ - FIELD_MAP           : Optional logical=json_key overrides for AdGuard forks (e.g. queries=dns_queries)
+ - STATE_FILE          : Optional path where querylog counters and the querylog position are saved each cycle and restored on startup
+ - EXPORTER_TLS_CERT / EXPORTER_TLS_KEY : Serve metrics over HTTPS; the files are reloaded when they change
+ - EXPORTER_AUTH_USER / EXPORTER_AUTH_PASS : Require basic auth for /metrics (and /debug/metrics); _FILE variants are read too
+ - DEBUG_DUMP_INTERVAL : Log a one-line summary of key metrics at INFO every N seconds (default: 0, disabled)
+ - METRIC_NAMESPACE    : Prefix of every metric name (default: adguard)
+ - GROUP_METRICS_BY_SUBSYSTEM : Prefix stats/status/querylog metrics with adguard_stats_, adguard_status_
+                       and adguard_querylog_ instead of the flat adguard_ names (default: false)
+ - HTTP_READ_TIMEOUT   : Exporter HTTP server read timeout in seconds (default: 10)
+ - HTTP_WRITE_TIMEOUT  : Exporter HTTP server write timeout in seconds (default: 30)
+ - HTTP_IDLE_TIMEOUT   : Exporter HTTP server keep-alive idle timeout in seconds (default: 60)
 */
 
-var logLevelMap = map[string]int{"ERROR": 1, "WARN": 2, "INFO": 3, "DEBUG": 4}
-var currentLogLevel = 3 // default to INFO
+var logLevelMap = map[string]int32{"ERROR": 1, "WARN": 2, "INFO": 3, "DEBUG": 4}
+
+// currentLogLevel and logJSON are read by every log call and replaced when
+// SIGHUP reloads the configuration, hence atomic.
+var currentLogLevel = func() *atomic.Int32 {
+	level := new(atomic.Int32)
+	level.Store(logLevelMap["INFO"])
+	return level
+}()
 
 func initLogger() {
-        level := os.Getenv("LOG_LEVEL")
-        if level == "" {
-                level = "INFO"
-        }
-        if val, ok := logLevelMap[level]; ok {
-                currentLogLevel = val
-        }
+	level := os.Getenv("LOG_LEVEL")
+	if level == "" {
+		level = "INFO"
+	}
+	if val, ok := logLevelMap[level]; ok {
+		currentLogLevel.Store(val)
+	}
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "text":
+		logJSON.Store(false)
+	case "json":
+		logJSON.Store(true)
+	default:
+		logX("WARN", "Unknown LOG_FORMAT %q, using text", format)
+	}
+}
+
+// logJSON writes one JSON object per log line (LOG_FORMAT=json) instead of text.
+var logJSON atomic.Bool
+
+// scrapeID identifies the running updateMetrics cycle in DEBUG/WARN/ERROR logs.
+var scrapeID atomic.Value
+
+func newScrapeID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func currentScrapeID() string {
+	id, _ := scrapeID.Load().(string)
+	return id
 }
 
 func logX(level string, format string, args ...interface{}) {
-        if logLevelMap[level] <= currentLogLevel {
-                log.Printf("[%s] %s", level, fmt.Sprintf(format, args...))
-        }
+	logKV(level, fmt.Sprintf(format, args...))
+}
+
+// logKV logs msg with structured key/value pairs. Text lines append them as
+// key=value; JSON lines carry them as fields next to level, msg and ts.
+func logKV(level, msg string, kv ...interface{}) {
+	if logLevelMap[level] > currentLogLevel.Load() {
+		return
+	}
+	id := currentScrapeID()
+	if level == "INFO" {
+		id = ""
+	}
+
+	if logJSON.Load() {
+		entry := map[string]interface{}{"level": level, "msg": msg, "ts": time.Now().UTC().Format(time.RFC3339Nano)}
+		if id != "" {
+			entry["scrape"] = id
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			v := kv[i+1]
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry[fmt.Sprint(kv[i])] = v
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"level": level, "msg": msg, "log_error": err.Error()})
+		}
+		log.Writer().Write(append(line, '\n'))
+		return
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		msg += fmt.Sprintf(" %v=%v", kv[i], kv[i+1])
+	}
+	if id != "" {
+		log.Printf("[%s] [scrape=%s] %s", level, id, msg)
+		return
+	}
+	log.Printf("[%s] %s", level, msg)
 }
 
 type AdGuardStats struct {
-        NumDNSQueries       float64              `json:"num_dns_queries"`
-        NumBlockedFiltering float64              `json:"num_blocked_filtering"`
-        NumReplacedParental float64              `json:"num_replaced_parental"`
-        AvgProcessingTime   float64              `json:"avg_processing_time"`
-        TopQueriedDomains   []map[string]float64 `json:"top_queried_domains"`
-        TopBlockedDomains   []map[string]float64 `json:"top_blocked_domains"`
-        TopClients          []map[string]float64 `json:"top_clients"`
-        TopUpstream         []map[string]float64 `json:"top_upstreams_responses"`
-        TopUpstreamTime     []map[string]float64 `json:"top_upstreams_avg_time"`
+	NumDNSQueries           float64 `json:"num_dns_queries"`
+	NumBlockedFiltering     float64 `json:"num_blocked_filtering"`
+	NumReplacedParental     float64 `json:"num_replaced_parental"`
+	NumReplacedSafebrowsing float64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   float64 `json:"num_replaced_safesearch"`
+	// AvgProcessingTime and the TopUpstreamTime values are in seconds.
+	AvgProcessingTime float64              `json:"avg_processing_time"`
+	TopQueriedDomains []map[string]float64 `json:"top_queried_domains"`
+	TopBlockedDomains []map[string]float64 `json:"top_blocked_domains"`
+	TopClients        []map[string]float64 `json:"top_clients"`
+	TopUpstream       []map[string]float64 `json:"top_upstreams_responses"`
+	TopUpstreamTime   []map[string]float64 `json:"top_upstreams_avg_time"`
 }
 
 type AdGuardStatus struct {
-        Version                    string   `json:"version"`
-        Language                   string   `json:"language"`
-        DNSAddresses               []string `json:"dns_addresses"`
-        DNSPort                    int      `json:"dns_port"`
-        HTTPPort                   int      `json:"http_port"`
-        ProtectionDisabledDuration int      `json:"protection_disabled_duration"`
-        ProtectionEnabled          bool     `json:"protection_enabled"`
-        DHCPAvailable              bool     `json:"dhcp_available"`
-        Running                    bool     `json:"running"`
+	Version                    string   `json:"version"`
+	Language                   string   `json:"language"`
+	DNSAddresses               []string `json:"dns_addresses"`
+	DNSPort                    int      `json:"dns_port"`
+	HTTPPort                   int      `json:"http_port"`
+	ProtectionDisabledDuration int      `json:"protection_disabled_duration"`
+	ProtectionEnabled          bool     `json:"protection_enabled"`
+	DHCPAvailable              bool     `json:"dhcp_available"`
+	Running                    bool     `json:"running"`
+	// ProtectionDisabledReason is not reported by upstream AdGuard Home; it is
+	// decoded for versions/forks that do and derived otherwise.
+	ProtectionDisabledReason string `json:"protection_disabled_reason"`
+}
+
+type AdGuardStatsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Interval is the statistics retention period in milliseconds.
+	Interval float64 `json:"interval"`
+}
+
+// DayRange is a daily interval in milliseconds since midnight.
+type DayRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// BlockedServicesSchedule lists, per weekday, when AdGuard pauses blocking of
+// the blocked services.
+type BlockedServicesSchedule struct {
+	TimeZone string    `json:"time_zone"`
+	Sun      *DayRange `json:"sun"`
+	Mon      *DayRange `json:"mon"`
+	Tue      *DayRange `json:"tue"`
+	Wed      *DayRange `json:"wed"`
+	Thu      *DayRange `json:"thu"`
+	Fri      *DayRange `json:"fri"`
+	Sat      *DayRange `json:"sat"`
+}
+
+type AdGuardBlockedServices struct {
+	IDs      []string                 `json:"ids"`
+	Schedule *BlockedServicesSchedule `json:"schedule"`
+}
+
+// AdGuardRewrite is a custom DNS rewrite rule from /control/rewrite/list.
+type AdGuardRewrite struct {
+	Domain string `json:"domain"`
+	Answer string `json:"answer"`
+}
+
+// AdGuardClient is a persistent client configured in AdGuard. IDs are the
+// IPs, CIDRs, MACs or ClientIDs the client is matched by.
+type AdGuardClient struct {
+	Name                string   `json:"name"`
+	IDs                 []string `json:"ids"`
+	UseGlobalSettings   bool     `json:"use_global_settings"`
+	FilteringEnabled    bool     `json:"filtering_enabled"`
+	ParentalEnabled     bool     `json:"parental_enabled"`
+	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled"`
+}
+
+// AdGuardAutoClient is a client AdGuard named on its own, e.g. from rDNS,
+// DHCP or /etc/hosts.
+type AdGuardAutoClient struct {
+	Name   string `json:"name"`
+	IP     string `json:"ip"`
+	Source string `json:"source"`
+}
+
+type AdGuardClients struct {
+	Clients     []AdGuardClient     `json:"clients"`
+	AutoClients []AdGuardAutoClient `json:"auto_clients"`
+}
+
+type AdGuardFilter struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Enabled     bool   `json:"enabled"`
+	RulesCount  int    `json:"rules_count"`
+	LastUpdated string `json:"last_updated"`
+}
+
+type AdGuardFiltering struct {
+	Enabled          bool            `json:"enabled"`
+	Filters          []AdGuardFilter `json:"filters"`
+	WhitelistFilters []AdGuardFilter `json:"whitelist_filters"`
+}
+
+type DHCPLease struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	// Expires is empty for static leases.
+	Expires string `json:"expires"`
+}
+
+type AdGuardDHCP struct {
+	Enabled      bool        `json:"enabled"`
+	Leases       []DHCPLease `json:"leases"`
+	StaticLeases []DHCPLease `json:"static_leases"`
+}
+
+type QueryLogEntry struct {
+	Question struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"question"`
+	Answer   []interface{} `json:"answer"`
+	Reason   string        `json:"reason"`
+	Client   string        `json:"client"`
+	Elapsed  string        `json:"elapsedMs"`
+	Upstream string        `json:"upstream"`
+	Status   string        `json:"status"`
+	Cached   bool          `json:"cached"`
+	// ClientProto is the protocol the client queried over: doh, dot, doq,
+	// dnscrypt, or empty for plain DNS.
+	ClientProto string `json:"client_proto"`
+	Time        string `json:"time"`
+	// ServiceName is only set for FilteredBlockedService entries on AdGuard versions
+	// that report it.
+	ServiceName string `json:"service_name"`
+	// Rules lists the matched filtering rules on v0.107 and later; older
+	// versions report a single Rule and the FilterID of its list.
+	Rules    []QueryLogRule `json:"rules"`
+	Rule     string         `json:"rule"`
+	FilterID int64          `json:"filterId"`
+}
+
+// QueryLogRule is a filtering rule that matched a query. Custom filtering
+// rules have filter list ID 0.
+type QueryLogRule struct {
+	FilterListID int64  `json:"filter_list_id"`
+	Text         string `json:"text"`
 }
 
 type AdGuardQueryLog struct {
-        Data []struct {
-                Question struct {
-                        Type string `json:"type"`
-                        Name string `json:"name"`
-                } `json:"question"`
-                Answer []interface{} `json:"answer"`
-                Reason   string   `json:"reason"`
-                Client   string   `json:"client"`
-                Elapsed  string   `json:"elapsedMs"`
-                Upstream string   `json:"upstream"`
-        } `json:"data"`
+	Data   []QueryLogEntry `json:"data"`
+	Oldest string          `json:"oldest"`
+}
+
+// startupEnv reads name while the package is initialised, before init(), for
+// the settings the metric names below depend on.
+func startupEnv(name string) string {
+	loadStartupEnv()
+	return os.Getenv(name)
+}
+
+// groupBySubsystem is GROUP_METRICS_BY_SUBSYSTEM.
+var groupBySubsystem, _ = strconv.ParseBool(startupEnv("GROUP_METRICS_BY_SUBSYSTEM"))
+
+// metricNamespace (METRIC_NAMESPACE) prefixes every metric name.
+var metricNamespace = func() string {
+	ns := startupEnv("METRIC_NAMESPACE")
+	if ns == "" {
+		return "adguard"
+	}
+	if !validNamespace(ns) {
+		logX("WARN", "Invalid METRIC_NAMESPACE %q, using adguard", ns)
+		return "adguard"
+	}
+	return ns
+}()
+
+// validNamespace reports whether ns can start a Prometheus metric name.
+func validNamespace(ns string) bool {
+	for i, r := range ns {
+		letter := r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
 }
 
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
 var (
-        dnsQueries = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_dns_queries_total", Help: "Total DNS queries received",
-        })
-        blockedFiltering = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_blocked_filtering_total", Help: "Total DNS queries blocked",
-        })
-        replacedParental = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_replaced_parental", Help: "Total parental-replaced queries",
-        })
-        avgProcessingTime = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_avg_processing_time", Help: "Avg DNS processing time (ms)",
-        })
-        statusProtectionEnabled = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_protection_enabled", Help: "Protection enabled (1/0)",
-        })
-        statusRunning = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_running", Help: "AdGuard service running (1/0)",
-        })
-        statusDHCPAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_dhcp_available", Help: "DHCP available (1/0)",
-        })
-        statusDisabledDuration = prometheus.NewGauge(prometheus.GaugeOpts{
-                Name: "adguard_protection_disabled_duration_seconds",
-                Help: "Time since protection disabled (s)",
-        })
-        versionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_version_info", Help: "AdGuard version info",
-        }, []string{"version"})
-
-        topQueriedDomains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_top_queried_domain_total", Help: "Top queried domains",
-        }, []string{"domain"})
-        topBlockedDomains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_top_blocked_domain_total", Help: "Top blocked domains",
-        }, []string{"domain"})
-        topClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_top_client_total", Help: "Top client IPs",
-        }, []string{"client"})
-        topUpstreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_top_upstream_total", Help: "Top upstream servers",
-        }, []string{"upstream"})
-        topUpstreamTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-                Name: "adguard_upstream_avg_response_time_seconds",
-                Help: "Avg response time per upstream (s)",
-        }, []string{"upstream"})
-
-        queryCountByReason = prometheus.NewCounterVec(prometheus.CounterOpts{
-                Name: "adguard_query_reason_total", Help: "Total queries by reason",
-        }, []string{"reason"})
-        queryCountByType = prometheus.NewCounterVec(prometheus.CounterOpts{
-                Name: "adguard_query_type_total", Help: "Total queries by DNS type",
-        }, []string{"type"})
-        queryHistogramByClient = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-                Name:    "adguard_query_elapsed_ms",
-                Help:    "Query duration by client in ms",
-                Buckets: prometheus.LinearBuckets(1, 5, 10),
-        }, []string{"client"})
-        queryCountByUpstream = prometheus.NewCounterVec(prometheus.CounterOpts{
-                Name: "adguard_query_upstream_total",
-                Help: "Total queries per upstream DNS server",
-        }, []string{"upstream"})
-        queryCountByDomain = prometheus.NewCounterVec(prometheus.CounterOpts{
-                Name: "adguard_query_domain_total",
-                Help: "Total queries per domain",
-        }, []string{"domain"})
-        queryCountClientReason = prometheus.NewCounterVec(prometheus.CounterOpts{
-                Name: "adguard_query_client_reason_total",
-                Help: "Total queries by client and reason",
-        }, []string{"client", "reason"})
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "dev"
 )
 
+// subsystem returns group as the metric subsystem when grouping is enabled, so
+// e.g. adguard_dns_queries_total becomes adguard_stats_dns_queries_total.
+func subsystem(group string) string {
+	if groupBySubsystem {
+		return group
+	}
+	return ""
+}
+
+var (
+	dnsQueries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "dns_queries_total", Help: "Total DNS queries received",
+	}, []string{"instance"})
+	blockedFiltering = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "blocked_filtering_total", Help: "Total DNS queries blocked",
+	}, []string{"instance"})
+	replacedParental = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "replaced_parental", Help: "Total parental-replaced queries",
+	}, []string{"instance"})
+	replacedSafebrowsing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "replaced_safebrowsing", Help: "Total queries blocked by Safe Browsing",
+	}, []string{"instance"})
+	replacedSafesearch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "replaced_safesearch", Help: "Total queries rewritten by Safe Search",
+	}, []string{"instance"})
+	blockedAll = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "blocked_all_total",
+		Help: "Total blocked queries: filtering + safe browsing + safe search + parental",
+	}, []string{"instance"})
+	blockRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "block_ratio",
+		Help: "Share of DNS queries blocked by filter lists (0 when there were no queries)",
+	}, []string{"instance"})
+	avgProcessingTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "avg_processing_time", Help: "Avg DNS processing time (s)",
+	}, []string{"instance"})
+	statusProtectionEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "protection_enabled", Help: "Protection enabled (1/0)",
+	}, []string{"instance"})
+	protectionStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "protection_status",
+		Help: "Protection state; the current state is 1, the other 0",
+	}, []string{"instance", "state"})
+	statusRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "running", Help: "AdGuard service running (1/0)",
+	}, []string{"instance"})
+	statusDHCPAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "dhcp_available", Help: "DHCP available (1/0)",
+	}, []string{"instance"})
+	statusDisabledDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "protection_disabled_duration_seconds",
+		Help: "Time since protection disabled (s)",
+	}, []string{"instance"})
+	statusDNSPort = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "dns_port", Help: "Port the AdGuard DNS server listens on",
+	}, []string{"instance"})
+	statusHTTPPort = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "http_port", Help: "Port the AdGuard web interface listens on",
+	}, []string{"instance"})
+	statusDNSAddresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "dns_addresses_count", Help: "Number of addresses the AdGuard DNS server listens on",
+	}, []string{"instance"})
+	protectionLastChange = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "protection_last_change_timestamp",
+		Help: "Unix time protection was last seen being enabled or disabled; absent until a change is observed, unless protection is off at the first scrape",
+	}, []string{"instance"})
+	protectionDisabledReason = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "protection_disabled_reason_info",
+		Help: "Why protection is disabled (timed pause or manual); absent while enabled",
+	}, []string{"instance", "reason"})
+	versionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("status"),
+		Name: "version_info", Help: "AdGuard version info",
+	}, []string{"instance", "version"})
+
+	topQueriedDomains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "top_queried_domain_total", Help: "Top queried domains",
+	}, []string{"instance", "domain"})
+	topBlockedDomains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "top_blocked_domain_total", Help: "Top blocked domains",
+	}, []string{"instance", "domain"})
+	topClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "top_client_total", Help: "Top client IPs, with the name AdGuard knows them by",
+	}, []string{"instance", "client", "name"})
+	topUpstreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "top_upstream_total", Help: "Top upstream servers",
+	}, []string{"instance", "upstream"})
+	topUpstreamTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("stats"),
+		Name: "upstream_avg_response_time_seconds",
+		Help: "Avg response time per upstream (s)",
+	}, []string{"instance", "upstream"})
+
+	queryCountByReason = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_reason_total", Help: "Total queries by reason",
+	}, []string{"instance", "reason"})
+	queryCountByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_type_total", Help: "Total queries by DNS type",
+	}, []string{"instance", "type"})
+	queryCountByUpstream = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_upstream_total",
+		Help: "Total queries per upstream DNS server",
+	}, []string{"instance", "upstream"})
+	upstreamSlow = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "upstream_slow_total",
+		Help: "Forwarded queries per upstream that took longer than UPSTREAM_SLOW_THRESHOLD_MS",
+	}, []string{"instance", "upstream"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "upstream_errors_total",
+		Help: "Forwarded queries per upstream that failed (NotFilteredError or SERVFAIL)",
+	}, []string{"instance", "upstream"})
+	queryCountByDomain = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_domain_total",
+		Help: "Total queries per domain",
+	}, []string{"instance", "domain"})
+	queryCountClientReason = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_client_reason_total",
+		Help: "Total queries by client and reason",
+	}, []string{"instance", "client", "reason"})
+
+	clientInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "client_info",
+		Help:      "Persistent clients configured in AdGuard, with their comma-joined IDs (always 1)",
+	}, []string{"instance", "name", "ids"})
+	clientFilteringEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "client_filtering_enabled",
+		Help:      "Whether filtering is enabled for each persistent client (1/0)",
+	}, []string{"instance", "name"})
+	clientParentalEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "client_parental_enabled",
+		Help:      "Whether parental control is enabled for each persistent client (1/0)",
+	}, []string{"instance", "name"})
+	clientSafeBrowsingEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "client_safebrowsing_enabled",
+		Help:      "Whether Safe Browsing is enabled for each persistent client (1/0)",
+	}, []string{"instance", "name"})
+	clientGlobalSettings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "client_use_global_settings",
+		Help:      "Whether each persistent client follows the global settings (1/0)",
+	}, []string{"instance", "name"})
+
+	dnsRewrites = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dns_rewrites_total",
+		Help:      "Custom DNS rewrites configured in AdGuard",
+	}, []string{"instance"})
+	dnsRewriteInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dns_rewrite_info",
+		Help:      "Custom DNS rewrites configured in AdGuard (always 1)",
+	}, []string{"instance", "domain", "answer"})
+
+	blockedServiceEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "blocked_service_enabled",
+		Help:      "Services AdGuard is configured to block (always 1)",
+	}, []string{"instance", "service"})
+	blockedServicesScheduleActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "blocked_services_schedule_active",
+		Help:      "Whether blocked services are currently blocked according to their schedule (1/0)",
+	}, []string{"instance"})
+
+	statsRetentionDays = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "stats_retention_days",
+		Help:      "Retention period of AdGuard's statistics in days",
+	}, []string{"instance"})
+	statsIntervalSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "stats_interval_seconds",
+		Help:      "Window AdGuard aggregates /control/stats over, in seconds",
+	}, []string{"instance"})
+	statsEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "stats_enabled",
+		Help:      "Whether AdGuard's statistics collection is enabled (1/0)",
+	}, []string{"instance"})
+
+	safeSearchEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "safesearch_service_enabled",
+		Help:      "Safe search enforced per service (1/0); \"global\" on older AdGuard versions",
+	}, []string{"instance", "service"})
+
+	dhcpEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dhcp_enabled",
+		Help:      "Whether AdGuard's DHCP server is enabled (1/0)",
+	}, []string{"instance"})
+	dhcpLeases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dhcp_leases_total",
+		Help:      "Number of dynamic DHCP leases",
+	}, []string{"instance"})
+	dhcpStaticLeases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dhcp_static_leases_total",
+		Help:      "Number of static DHCP leases",
+	}, []string{"instance"})
+	dhcpLeaseExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "dhcp_lease_expiry_timestamp_seconds",
+		Help:      "Unix time each DHCP lease expires (0 for static leases)",
+	}, []string{"instance", "ip", "mac"})
+
+	replicaQueryLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "replica_query_lag",
+		Help:      "Primary minus replica num_dns_queries",
+	}, []string{"instance"})
+
+	filtersTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "filters_total",
+		Help:      "Configured filter lists (list=blocklist|allowlist)",
+	}, []string{"instance", "list"})
+	filtersEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "filters_enabled",
+		Help:      "Enabled filter lists (list=blocklist|allowlist)",
+	}, []string{"instance", "list"})
+	filterRulesCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "filter_rules_count",
+		Help:      "Rules loaded from each filter list",
+	}, []string{"instance", "list", "name", "url"})
+	filterEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "filter_enabled",
+		Help:      "Whether each filter list is enabled (1/0)",
+	}, []string{"instance", "list", "name"})
+	filterLastUpdated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "filter_last_updated_timestamp",
+		Help:      "Unix time each filter list was last updated",
+	}, []string{"instance", "list", "name"})
+
+	rewriteHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "rewrite_hits_total",
+		Help: "Total queries answered by a DNS rewrite, per domain",
+	}, []string{"instance", "domain"})
+
+	blockedCustomAnswer = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "blocked_custom_answer_info",
+		Help: "Answers served for blocked queries in the last querylog window (1 = seen)",
+	}, []string{"instance", "type", "answer"})
+
+	clientLastSeen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "client_last_seen_timestamp_seconds",
+		Help: "Unix time of the most recent querylog entry per client",
+	}, []string{"instance", "client"})
+
+	clientUpstreamCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "client_upstream_count",
+		Help: "Distinct upstreams that served each client in the last querylog window",
+	}, []string{"instance", "client"})
+
+	cacheHitRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "cache_hit_ratio",
+		Help: "Share of querylog entries in the last window answered from AdGuard's cache",
+	}, []string{"instance"})
+
+	queryLogIncomplete = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "querylog_incomplete_entries_total",
+		Help:      "Querylog entries with a blank key field, by field",
+	}, []string{"instance", "field"})
+
+	queryCountByTLD = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_tld_total",
+		Help: "Total queries by top-level domain (public suffix)",
+	}, []string{"instance", "tld"})
+
+	queryBlockedByFilter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_blocked_by_filter_total",
+		Help: "Total blocked queries per filter list whose rule matched (0 = custom rules)",
+	}, []string{"instance", "filter_id"})
+
+	queryCountByRcode = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_rcode_total",
+		Help: "Total queries by DNS response code",
+	}, []string{"instance", "rcode"})
+	queryCountByProto = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_proto_total",
+		Help: "Total queries by the protocol the client used (plain, doh, dot, doq, dnscrypt)",
+	}, []string{"instance", "proto"})
+	queryAnswered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "query_answered_total",
+		Help: "Total queries by whether the response carried any answer records",
+	}, []string{"instance", "answered"})
+
+	blockedServices = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name: "blocked_service_total",
+		Help: "Total queries blocked by the blocked services feature, per service",
+	}, []string{"instance", "service"})
+
+	queryLogPagesFetched = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "querylog_pages_fetched",
+		Help:      "Querylog pages fetched during the last scrape",
+	}, []string{"instance"})
+	queryLogEntriesProcessed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "querylog_entries_processed",
+		Help:      "Querylog entries processed during the last scrape",
+	}, []string{"instance"})
+	queryLogEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "querylog_entries_total",
+		Help:      "Querylog entries processed since the exporter started",
+	}, []string{"instance"})
+	queryLogTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "querylog_truncated_windows_total",
+		Help:      "Aligned querylog windows cut short by QUERYLOG_MAX_PAGES; the unread rest is counted by the following scrapes",
+	}, []string{"instance"})
+
+	updateCycleDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "update_cycle_duration_seconds",
+		Help:      "Duration of the last full update cycle, including all fetches and metric writes",
+	})
+
+	scrapeDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "scrape_duration_seconds",
+		Help:      "Duration of the last scrape loop iteration, including saving STATE_FILE",
+	})
+	scrapeOverruns = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "scrape_overruns_total",
+		Help:      "Scrape ticks skipped because the previous scrape was still running",
+	})
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "scrape_errors_total",
+		Help:      "Failed requests to the stats, status and querylog endpoints",
+	}, []string{"instance", "endpoint"})
+
+	decodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricNamespace,
+		Name:      "decode_duration_seconds",
+		Help:      "Time spent decoding AdGuard API responses by endpoint, excluding the network fetch",
+	}, []string{"instance", "endpoint"})
+
+	exporterBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "exporter_build_info",
+		Help:      "Build of the running exporter, always 1",
+	}, []string{"version", "commit", "goversion"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "exporter_http_requests_total",
+		Help:      "Requests served by the exporter's HTTP handlers, by path and status code",
+	}, []string{"path", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricNamespace,
+		Name:      "exporter_http_request_duration_seconds",
+		Help:      "Latency of the exporter's HTTP handlers",
+	}, []string{"path"})
+
+	scrapeGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "exporter_scrape_goroutines",
+		Help:      "Goroutines currently spawned by the exporter's scrape (per-endpoint fetches and querylog workers); should return to 0 between scrapes",
+	})
+
+	retryBudgetExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "retry_budget_exhausted_total",
+		Help:      "Retries skipped because the scrape cycle's RETRY_BUDGET was used up",
+	})
+
+	configWarnings = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "exporter_config_warnings_total",
+		Help:      "Advisory warnings raised about the exporter configuration at startup",
+	})
+
+	adguardUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "up",
+		Help:      "Whether the last scrape of stats, status and querylog all succeeded (1/0)",
+	}, []string{"instance"})
+	endpointUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "endpoint_up",
+		Help:      "Whether the last request to each core AdGuard endpoint succeeded (1/0)",
+	}, []string{"instance", "endpoint"})
+
+	scrapeSuccessRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "scrape_success_ratio",
+		Help:      "Ratio of successful scrapes over the last SCRAPE_SUCCESS_WINDOW cycles",
+	})
+)
+
+// scrapeHistory is a fixed-size ring buffer of recent scrape outcomes.
+type scrapeHistory struct {
+	outcomes []bool
+	next     int
+	count    int
+}
+
+func newScrapeHistory(size int) *scrapeHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &scrapeHistory{outcomes: make([]bool, size)}
+}
+
+// record stores the outcome of a scrape, overwriting the oldest one once full.
+func (h *scrapeHistory) record(success bool) {
+	h.outcomes[h.next] = success
+	h.next = (h.next + 1) % len(h.outcomes)
+	if h.count < len(h.outcomes) {
+		h.count++
+	}
+}
+
+// ratio returns successful/total over the recorded outcomes, or 0 if none.
+func (h *scrapeHistory) ratio() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	ok := 0
+	for i := 0; i < h.count; i++ {
+		if h.outcomes[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(h.count)
+}
+
+var history = newScrapeHistory(10)
+
+// scrapeInterval is the configured SCRAPE_INTERVAL, set in main.
+var scrapeInterval = 15 * time.Second
+
+// minRecommendedScrapeInterval is roughly how often AdGuard's stats move;
+// scraping faster only re-reads the same numbers.
+const minRecommendedScrapeInterval = 5 * time.Second
+
+// checkScrapeInterval warns (without failing) when interval is below
+// minRecommendedScrapeInterval. It reports whether a warning was raised.
+func checkScrapeInterval(interval time.Duration) bool {
+	if interval >= minRecommendedScrapeInterval {
+		return false
+	}
+	logX("WARN", "SCRAPE_INTERVAL of %s is below the recommended minimum of %s; AdGuard stats will mostly repeat between scrapes", interval, minRecommendedScrapeInterval)
+	configWarnings.Inc()
+	return true
+}
+
+// apiRequestDuration is created in init so its buckets can come from API_LATENCY_BUCKETS.
+var apiRequestDuration *prometheus.HistogramVec
+
+// The querylog latency histograms are created in init so their buckets can
+// come from QUERY_LATENCY_BUCKETS.
+var queryHistogramByClient, queryHistogramByType *prometheus.HistogramVec
+
+// parseBuckets parses a comma-separated list of increasing bucket boundaries,
+// returning def if the list is empty or malformed.
+func parseBuckets(raw string, def []float64) []float64 {
+	if raw == "" {
+		return def
+	}
+	var buckets []float64
+	for _, part := range strings.Split(raw, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || (len(buckets) > 0 && b <= buckets[len(buckets)-1]) {
+			logX("WARN", "Ignoring malformed bucket list %q", raw)
+			return def
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// labelCap bounds the number of distinct values a label may take. Once the
+// limit is reached, unseen values are folded into "other".
+type labelCap struct {
+	mu    sync.Mutex
+	limit int
+	seen  map[string]struct{}
+}
+
+func newLabelCap(limit int) *labelCap {
+	return &labelCap{limit: limit, seen: make(map[string]struct{})}
+}
+
+func (c *labelCap) value(v string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[v]; ok {
+		return v
+	}
+	if c.limit > 0 && len(c.seen) >= c.limit {
+		return "other"
+	}
+	c.seen[v] = struct{}{}
+	return v
+}
+
+var rewriteDomainCap = newLabelCap(1000)
+var clientCap = newLabelCap(1000)
+var tldCap = newLabelCap(1000)
+
+// tldMetrics enables adguard_query_tld_total (ENABLE_TLD_METRICS).
+var tldMetrics = false
+
+// tldLabel returns the public suffix (eTLD) of a queried name, e.g. "co.uk" for
+// "www.bbc.co.uk", or "invalid" for names that can't be a domain.
+func tldLabel(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "..") ||
+		strings.ContainsAny(name, " /\\") {
+		return "invalid"
+	}
+	suffix, _ := publicsuffix.PublicSuffix(name)
+	return suffix
+}
+
+// knownReasons are the filtering reasons AdGuard Home reports in its querylog.
+var knownReasons = []string{
+	"NotFilteredNotFound", "NotFilteredWhiteList", "NotFilteredError",
+	"FilteredBlackList", "FilteredSafeBrowsing", "FilteredParental", "FilteredInvalid",
+	"FilteredSafeSearch", "FilteredBlockedService",
+	"Rewrite", "RewriteEtcHosts", "RewriteRule",
+}
+
+// reasonAllowlist bounds the reason label; anything not on it is reported as "other".
+var reasonAllowlist = newReasonAllowlist(knownReasons)
+
+func newReasonAllowlist(reasons []string) map[string]bool {
+	allow := make(map[string]bool, len(reasons))
+	for _, r := range reasons {
+		if r = strings.TrimSpace(r); r != "" {
+			allow[r] = true
+		}
+	}
+	return allow
+}
+
+func reasonLabel(reason string) string {
+	if reasonAllowlist[reason] {
+		return reason
+	}
+	return "other"
+}
+
+// blockedAnswerInfo enables adguard_blocked_custom_answer_info (ENABLE_BLOCKED_ANSWER_INFO).
+var blockedAnswerInfo = false
+
+// exemplarsEnabled attaches the client and upstream of each query to the
+// per-client latency histogram as exemplars and serves OpenMetrics, the only
+// format that carries them (ENABLE_EXEMPLARS).
+var exemplarsEnabled = false
+
+// queryLogEnabled fetches /control/querylog and exposes the metrics derived
+// from it (ENABLE_QUERYLOG). Disabled, neither is done.
+var queryLogEnabled = true
+
+// blockedOnlyMode fetches only blocked querylog entries and updates just the
+// block-oriented querylog metrics (BLOCKED_ONLY_MODE).
+var blockedOnlyMode = false
+
+// maxLabelLength limits the length of domain, client and upstream label values; 0 disables it.
+var maxLabelLength = 0
+
+// sanitizeLabel truncates overly long label values, marking the cut with an ellipsis.
+func sanitizeLabel(v string) string {
+	if maxLabelLength <= 0 || utf8.RuneCountInString(v) <= maxLabelLength {
+		return v
+	}
+	return string([]rune(v)[:maxLabelLength]) + "…"
+}
+
+// upstreamNormalize groups upstream labels by hostname (UPSTREAM_NORMALIZE).
+var upstreamNormalize = false
+
+// normalizeUpstream strips the protocol, port and path from an upstream such as
+// https://dns.google:443/dns-query or tls://1.1.1.1:853, leaving the hostname.
+// Bare IPs and host:port pairs are handled without a scheme.
+func normalizeUpstream(up string) string {
+	if strings.Contains(up, "://") {
+		if u, err := url.Parse(up); err == nil && u.Hostname() != "" {
+			return strings.ToLower(u.Hostname())
+		}
+	}
+	if host, _, err := net.SplitHostPort(up); err == nil {
+		up = host
+	}
+	return strings.ToLower(strings.Trim(up, "[]"))
+}
+
+// upstreamLabel returns the label value for an upstream, normalized when
+// UPSTREAM_NORMALIZE is set.
+func upstreamLabel(up string) string {
+	if upstreamNormalize && up != "" {
+		up = normalizeUpstream(up)
+	}
+	return sanitizeLabel(up)
+}
+
 func init() {
-        _ = godotenv.Load()
-        initLogger()
-        prometheus.MustRegister(
-                dnsQueries, blockedFiltering, replacedParental, avgProcessingTime,
-                statusProtectionEnabled, statusRunning, statusDHCPAvailable, statusDisabledDuration, versionInfo,
-                topQueriedDomains, topBlockedDomains, topClients, topUpstreams, topUpstreamTime,
-                queryCountByReason, queryCountByType, queryHistogramByClient,
-                queryCountByUpstream, queryCountByDomain, queryCountClientReason,
-        )
+	loadStartupEnv()
+	initLogger()
+	logConfigSources()
+	if n, err := strconv.Atoi(os.Getenv("SCRAPE_SUCCESS_WINDOW")); err == nil && n > 0 {
+		history = newScrapeHistory(n)
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_LABEL_VALUES")); err == nil && n >= 0 {
+		rewriteDomainCap = newLabelCap(n)
+		clientCap = newLabelCap(n)
+		tldCap = newLabelCap(n)
+	}
+	if raw := os.Getenv("REASON_LABEL_ALLOWLIST"); raw != "" {
+		reasonAllowlist = newReasonAllowlist(strings.Split(raw, ","))
+	}
+	if ms, err := strconv.ParseFloat(os.Getenv("UPSTREAM_SLOW_THRESHOLD_MS"), 64); err == nil && ms > 0 {
+		upstreamSlowThresholdMs = ms
+	}
+	if n, err := strconv.Atoi(os.Getenv("QUERYLOG_WORKERS")); err == nil && n > 0 {
+		queryLogWorkers = n
+	}
+	tldMetrics, _ = strconv.ParseBool(os.Getenv("ENABLE_TLD_METRICS"))
+	blockedAnswerInfo, _ = strconv.ParseBool(os.Getenv("ENABLE_BLOCKED_ANSWER_INFO"))
+	exemplarsEnabled, _ = strconv.ParseBool(os.Getenv("ENABLE_EXEMPLARS"))
+	blockedOnlyMode, _ = strconv.ParseBool(os.Getenv("BLOCKED_ONLY_MODE"))
+	if enabled, err := strconv.ParseBool(os.Getenv("ENABLE_QUERYLOG")); err == nil {
+		queryLogEnabled = enabled
+	}
+	queryLogAlign, _ = strconv.ParseBool(os.Getenv("QUERYLOG_ALIGN_WINDOWS"))
+	upstreamNormalize, _ = strconv.ParseBool(os.Getenv("UPSTREAM_NORMALIZE"))
+	if n, err := strconv.Atoi(os.Getenv("ADGUARD_MAX_RETRIES")); err == nil && n >= 0 {
+		fetchRetries = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("RETRY_BUDGET")); err == nil && n >= 0 {
+		retryBudgetSize = n
+	}
+	resetRetryBudget()
+	skipVerify, _ := strconv.ParseBool(os.Getenv("ADGUARD_TLS_SKIP_VERIFY"))
+	tlsCfg, err := clientTLSConfig(os.Getenv("ADGUARD_CA_FILE"), skipVerify)
+	if err != nil {
+		logX("ERROR", "Failed to load ADGUARD_CA_FILE, using the system roots: %v", err)
+		tlsCfg, _ = clientTLSConfig("", skipVerify)
+	}
+	proxy, err := parseProxyURL(os.Getenv("ADGUARD_PROXY_URL"))
+	if err != nil {
+		logX("ERROR", "Ignoring invalid ADGUARD_PROXY_URL, using HTTP_PROXY/HTTPS_PROXY: %v", err)
+	}
+	httpClient = newHTTPClient(parseHTTPTimeout(os.Getenv("ADGUARD_HTTP_TIMEOUT")), tlsCfg, proxy)
+	if n, err := strconv.Atoi(os.Getenv("CLIENT_LAST_SEEN_TTL")); err == nil && n > 0 {
+		clientLastSeenTTL = time.Duration(n) * time.Second
+	}
+	if n, err := strconv.Atoi(os.Getenv("TOP_N_LIMIT")); err == nil && n >= 0 {
+		topNLimit = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("CLIENT_NAME_TTL")); err == nil && n > 0 {
+		clientNameTTL = time.Duration(n) * time.Second
+	}
+	if raw := os.Getenv("FIELD_MAP"); raw != "" {
+		fieldMap = parseFieldMap(raw)
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_LABEL_LENGTH")); err == nil && n >= 0 {
+		maxLabelLength = n
+	}
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of AdGuard API requests by endpoint",
+		Buckets:   parseBuckets(os.Getenv("API_LATENCY_BUCKETS"), prometheus.DefBuckets),
+	}, []string{"instance", "endpoint"})
+	queryLatencyBuckets := parseBuckets(os.Getenv("QUERY_LATENCY_BUCKETS"), prometheus.LinearBuckets(1, 5, 10))
+	queryHistogramByClient = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name:    "query_elapsed_ms",
+		Help:    "Query duration by client in ms",
+		Buckets: queryLatencyBuckets,
+	}, []string{"instance", "client"})
+	queryHistogramByType = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricNamespace, Subsystem: subsystem("querylog"),
+		Name:    "query_elapsed_by_type_ms",
+		Help:    "Query duration by DNS question type in ms",
+		Buckets: queryLatencyBuckets,
+	}, []string{"instance", "type"})
+	onDemandScrape = parseScrapeMode(os.Getenv("SCRAPE_MODE"))
+	collectors := []prometheus.Collector{
+		apiRequestDuration,
+		dnsQueries, blockedFiltering, replacedParental, avgProcessingTime,
+		replacedSafebrowsing, replacedSafesearch, blockedAll, blockRatio,
+		statusProtectionEnabled, statusRunning, statusDHCPAvailable, statusDisabledDuration, versionInfo, protectionLastChange,
+		statusDNSPort, statusHTTPPort, statusDNSAddresses, safeSearchEnabled, protectionStatus, protectionDisabledReason,
+		filtersTotal, filtersEnabled, filterRulesCount, filterEnabled, filterLastUpdated, replicaQueryLag, dhcpLeaseExpiry,
+		dhcpEnabled, dhcpLeases, dhcpStaticLeases,
+		clientInfo, clientFilteringEnabled, clientParentalEnabled, clientSafeBrowsingEnabled, clientGlobalSettings,
+		dnsRewrites, dnsRewriteInfo,
+		topQueriedDomains, topBlockedDomains, topClients, topUpstreams, topUpstreamTime,
+		scrapeSuccessRatio, updateCycleDuration,
+		configWarnings, exporterBuildInfo, httpRequests, httpRequestDuration, decodeDuration,
+		scrapeGoroutines, statsRetentionDays, statsIntervalSeconds, statsEnabled,
+		retryBudgetExhausted, blockedServicesScheduleActive, blockedServiceEnabled,
+		adguardUp, endpointUp, scrapeDuration, scrapeOverruns, scrapeErrors,
+	}
+	if queryLogEnabled {
+		collectors = append(collectors,
+			queryCountByReason, queryCountByType, queryHistogramByClient, queryHistogramByType,
+			queryCountByUpstream, upstreamSlow, upstreamErrors, queryCountByDomain, queryCountClientReason,
+			rewriteHits, blockedServices, queryBlockedByFilter, queryCountByRcode, queryCountByProto, queryAnswered, clientUpstreamCount,
+			blockedCustomAnswer, queryCountByTLD, cacheHitRatio, queryLogPagesFetched, queryLogEntriesProcessed, queryLogEntries,
+			queryLogTruncated, clientLastSeen, queryLogIncomplete,
+		)
+	} else {
+		logX("INFO", "ENABLE_QUERYLOG=false, querylog metrics are disabled")
+	}
+	registerer := prometheus.DefaultRegisterer
+	if labels := withoutClashes(parseExtraLabels(os.Getenv("EXTRA_LABELS")), collectors); len(labels) > 0 {
+		registerer = prometheus.WrapRegistererWith(labels, registerer)
+	}
+	if onDemandScrape {
+		onDemand = newOnDemandCollector(envSeconds("SCRAPE_TIMEOUT", 10), collectors...)
+		registerer.MustRegister(onDemand)
+	} else {
+		registerer.MustRegister(collectors...)
+	}
+	exporterBuildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+}
+
+// ratio returns part/total, or 0 when total is 0.
+func ratio(part, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return part / total
 }
 
 func boolToFloat(b bool) float64 {
-        if b {
-                return 1
-        }
-        return 0
-}
-
-func fetchStats() (*AdGuardStats, error) {
-	host := os.Getenv("ADGUARD_HOST")
-	user := os.Getenv("ADGUARD_USER")
-	pass := os.Getenv("ADGUARD_PASS")
-	url := host + "/control/stats"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.SetBasicAuth(user, pass)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// envOrFile returns the env var name or, when it is unset, the contents of the
+// file named by name_FILE (Docker and Kubernetes secrets) without trailing
+// newlines. The plain env var wins when both are set. Credentials are read when
+// the clients are built, so a rotated secret is picked up on SIGHUP.
+func envOrFile(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		logX("WARN", "Failed to read %s_FILE: %v", name, err)
+		return ""
 	}
-	defer resp.Body.Close()
+	return strings.TrimRight(string(data), "\r\n")
+}
 
-	body, err := io.ReadAll(resp.Body)
+// newRequest builds an authenticated GET request for an endpoint.
+func (c *Client) newRequest(ctx context.Context, endpoint, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpointURL(c.Host, path), nil)
 	if err != nil {
-		logX("ERROR", "Failed to read stats body: %v", err)
 		return nil, err
 	}
+	switch authMode() {
+	case "none":
+		return req, nil
+	case "cookie":
+		cookie, err := sessionCookie(ctx, c, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		req.AddCookie(cookie)
+		return req, nil
+	}
+	// AdGuard installs without authentication don't expect an Authorization header at all.
+	if user, pass := c.credentials(endpoint); user != "" || pass != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	return req, nil
+}
+
+// defaultHTTPTimeout bounds each AdGuard request unless ADGUARD_HTTP_TIMEOUT is set.
+const defaultHTTPTimeout = 10 * time.Second
+
+// httpClient is shared by every Client so connections are reused.
+var httpClient = &http.Client{Timeout: defaultHTTPTimeout}
+
+// parseHTTPTimeout reads ADGUARD_HTTP_TIMEOUT in whole seconds, falling back to
+// the default with a WARN on anything that isn't a positive integer.
+func parseHTTPTimeout(raw string) time.Duration {
+	if raw == "" {
+		return defaultHTTPTimeout
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		logX("WARN", "Invalid ADGUARD_HTTP_TIMEOUT %q, using %s", raw, defaultHTTPTimeout)
+		return defaultHTTPTimeout
+	}
+	return time.Duration(n) * time.Second
+}
+
+// fetchRetries is how often a failed AdGuard request is retried
+// (ADGUARD_MAX_RETRIES).
+var fetchRetries = 3
+
+// retryBackoff is the delay before the first retry; it doubles with each
+// further retry up to maxRetryBackoff.
+var retryBackoff = 250 * time.Millisecond
+
+const maxRetryBackoff = 4 * time.Second
+
+// retryDelay returns the backoff before retry attempt+1, jittered over the
+// upper half of the exponential delay so failing scrapes don't retry in step.
+func retryDelay(attempt int) time.Duration {
+	d := retryBackoff << attempt
+	if d > maxRetryBackoff || d <= 0 {
+		d = maxRetryBackoff
+	}
+	return d/2 + time.Duration(mathrand.Int64N(int64(d/2)+1))
+}
+
+// retryBudgetSize caps the retries of all endpoints within one scrape cycle
+// (RETRY_BUDGET), so a struggling AdGuard isn't hammered with retries.
+var retryBudgetSize = 5
+
+// retryBudget is the number of retries left in the current scrape cycle.
+var retryBudget atomic.Int64
+
+func resetRetryBudget() {
+	retryBudget.Store(int64(retryBudgetSize))
+}
+
+// takeRetry spends one retry from the cycle's budget, reporting false once
+// the budget is used up.
+func takeRetry() bool {
+	for {
+		n := retryBudget.Load()
+		if n <= 0 {
+			retryBudgetExhausted.Inc()
+			logX("WARN", "Retry budget of %d exhausted for this scrape cycle", retryBudgetSize)
+			return false
+		}
+		if retryBudget.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
 
-	var stats AdGuardStats
-	err = json.Unmarshal(body, &stats)
+// doRequest sends an authenticated GET for path. Network errors and 5xx
+// responses are retried with exponential backoff within ADGUARD_MAX_RETRIES and
+// the cycle's retry budget; 4xx responses such as rejected credentials are
+// not. Once retries run out the last 5xx response is returned to the caller.
+// A cancelled ctx aborts the request in flight and any pending retry.
+// It returns when the returned attempt started so the caller can time it.
+func (c *Client) doRequest(ctx context.Context, endpoint, path string) (*http.Response, time.Time, error) {
+	req, err := c.newRequest(ctx, endpoint, path)
 	if err != nil {
-		logX("ERROR", "Failed to unmarshal stats: %v", err)
-		return nil, err
+		return nil, time.Time{}, err
+	}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := c.http.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, start, nil
+		}
+		if err != nil {
+			apiRequestDuration.WithLabelValues(c.Host, endpoint).Observe(time.Since(start).Seconds())
+		}
+		if attempt >= fetchRetries || ctx.Err() != nil || !takeRetry() {
+			return resp, start, err
+		}
+		if err == nil {
+			apiRequestDuration.WithLabelValues(c.Host, endpoint).Observe(time.Since(start).Seconds())
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		delay := retryDelay(attempt)
+		logX("WARN", "Retrying %s in %s after error: %v", endpoint, delay.Round(time.Millisecond), err)
+		select {
+		case <-ctx.Done():
+			return nil, start, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
+}
 
-	return &stats, nil
+// statusError is the error fetchJSON returns for a non-200 response, so a
+// caller can tell an endpoint that doesn't exist apart from a failing one.
+type statusError struct {
+	endpoint string
+	code     int
 }
 
-func fetchStatus() (*AdGuardStatus, error) {
-	host := os.Getenv("ADGUARD_HOST")
-	user := os.Getenv("ADGUARD_USER")
-	pass := os.Getenv("ADGUARD_PASS")
-	url := host + "/control/status"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.SetBasicAuth(user, pass)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.endpoint, e.code)
+}
+
+// fetchJSON requests path and decodes the JSON response into v.
+func (c *Client) fetchJSON(ctx context.Context, endpoint, path string, v interface{}) error {
+	resp, start, err := c.doRequest(ctx, endpoint, path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if authMode() == "cookie" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		resp.Body.Close()
+		apiRequestDuration.WithLabelValues(c.Host, endpoint).Observe(time.Since(start).Seconds())
+		logX("DEBUG", "AdGuard rejected the session for %s, logging in again", endpoint)
+		invalidateSession(c, endpoint)
+		if resp, start, err = c.doRequest(ctx, endpoint, path); err != nil {
+			return err
+		}
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
+	apiRequestDuration.WithLabelValues(c.Host, endpoint).Observe(time.Since(start).Seconds())
 	if err != nil {
-		logX("ERROR", "Failed to read status body: %v", err)
-		return nil, err
+		logX("ERROR", "Failed to read %s body: %v", endpoint, err)
+		return err
+	}
+	if err := checkJSONResponse(path, resp, body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{endpoint: endpoint, code: resp.StatusCode}
 	}
 
-	var status AdGuardStatus
-	err = json.Unmarshal(body, &status)
+	decodeStart := time.Now()
+	err = decodeJSON(body, v)
+	decodeDuration.WithLabelValues(c.Host, endpoint).Observe(time.Since(decodeStart).Seconds())
 	if err != nil {
-		logX("ERROR", "Failed to unmarshal status: %v", err)
-		return nil, err
+		logX("ERROR", "Failed to unmarshal %s: %v", endpoint, err)
+		return err
 	}
 
-	return &status, nil
+	return nil
+}
+
+// checkJSONResponse rejects a response that is HTML rather than AdGuard's
+// JSON, typically a reverse proxy's login or error page, with an error saying
+// what came back instead of json's "invalid character '<'".
+func checkJSONResponse(path string, resp *http.Response, body []byte) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && !bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+		return nil
+	}
+	if mediaType == "" {
+		mediaType = "HTML without a Content-Type"
+	}
+	path, _, _ = strings.Cut(path, "?")
+	err := fmt.Errorf("expected JSON from %s, got %s (status %d)", path, mediaType, resp.StatusCode)
+	if resp.Request != nil && !strings.HasSuffix(resp.Request.URL.Path, path) {
+		err = fmt.Errorf("%w after a redirect to %s", err, resp.Request.URL.Redacted())
+	}
+	return err
 }
 
-func fetchQueryLog() (*AdGuardQueryLog, error) {
-	host := os.Getenv("ADGUARD_HOST")
-	user := os.Getenv("ADGUARD_USER")
-	pass := os.Getenv("ADGUARD_PASS")
-	url := host + "/control/querylog"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.SetBasicAuth(user, pass)
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+// maxLoginBackoff caps the doubling delay between startup login attempts.
+const maxLoginBackoff = 60 * time.Second
+
+// checkLogin performs an authenticated request and reports whether it was
+// accepted.
+func (c *Client) checkLogin(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "status", "/control/status")
 	if err != nil {
-		return nil, err
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logX("ERROR", "Failed to read querylog body: %v", err)
+// login waits for c's AdGuard to accept our credentials, retrying up
+// to retries times with an exponential backoff starting at interval. This keeps
+// the first scrape from failing when the exporter starts before AdGuard does.
+// It gives up early when ctx is cancelled.
+func login(ctx context.Context, c *Client, retries int, interval time.Duration) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err = c.checkLogin(ctx); err == nil {
+			logX("INFO", "Logged in to %s after %d attempt(s)", c.Host, attempt+1)
+			return nil
+		}
+		if attempt == retries {
+			break
+		}
+		logX("WARN", "Login attempt %d/%d to %s failed: %v (retrying in %s)", attempt+1, retries+1, c.Host, err, interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > maxLoginBackoff {
+			interval = maxLoginBackoff
+		}
+	}
+	return err
+}
+
+// startupLogins holds the instances whose startup login is still running.
+// The scrape skips them and /readyz reports not ready until none is left.
+var startupLogins = struct {
+	sync.Mutex
+	pending map[string]bool
+}{pending: map[string]bool{}}
+
+// startLogins runs login for every client in the background, so the exporter
+// serves /healthz right away and a slow or unreachable instance doesn't hold
+// up the others. A host that never accepts the login is scraped anyway.
+func startLogins(ctx context.Context, clients []*Client, retries int, interval time.Duration) {
+	for _, c := range clients {
+		startupLogins.Lock()
+		startupLogins.pending[c.Host] = true
+		startupLogins.Unlock()
+		go func(c *Client) {
+			if err := login(ctx, c, retries, interval); err != nil {
+				logX("ERROR", "Could not log in to %s, scraping it anyway: %v", c.Host, err)
+			}
+			startupLogins.Lock()
+			delete(startupLogins.pending, c.Host)
+			startupLogins.Unlock()
+		}(c)
+	}
+}
+
+// loginPending reports whether host's startup login is still running, or with
+// an empty host, whether any is.
+func loginPending(host string) bool {
+	startupLogins.Lock()
+	defer startupLogins.Unlock()
+	if host == "" {
+		return len(startupLogins.pending) > 0
+	}
+	return startupLogins.pending[host]
+}
+
+// fetchAs fetches path through c and decodes the response into a new T, so
+// each endpoint only needs its path and response type.
+func fetchAs[T any](ctx context.Context, c *Client, endpoint, path string) (*T, error) {
+	var v T
+	if err := c.fetchJSON(ctx, endpoint, path, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (c *Client) Stats(ctx context.Context) (*AdGuardStats, error) {
+	return fetchAs[AdGuardStats](ctx, c, "stats", "/control/stats")
+}
+
+// ReplicaStats fetches stats from the ADGUARD_REPLICA_HOST client, using
+// REPLICA_USER/REPLICA_PASS or the global credentials.
+func (c *Client) ReplicaStats(ctx context.Context) (*AdGuardStats, error) {
+	return fetchAs[AdGuardStats](ctx, c, "replica", "/control/stats")
+}
+
+func (c *Client) Status(ctx context.Context) (*AdGuardStatus, error) {
+	return fetchAs[AdGuardStatus](ctx, c, "status", "/control/status")
+}
+
+func (c *Client) Filtering(ctx context.Context) (*AdGuardFiltering, error) {
+	return fetchAs[AdGuardFiltering](ctx, c, "filtering", "/control/filtering/status")
+}
+
+func (c *Client) DHCP(ctx context.Context) (*AdGuardDHCP, error) {
+	return fetchAs[AdGuardDHCP](ctx, c, "dhcp", "/control/dhcp/status")
+}
+
+const millisecondsPerDay = 24 * 60 * 60 * 1000
+
+// StatsConfig reads /control/stats/config, falling back to the older
+// /control/stats_info, which reports the interval in days (0 = disabled).
+func (c *Client) StatsConfig(ctx context.Context) (*AdGuardStatsConfig, error) {
+	var cfg AdGuardStatsConfig
+	err := c.fetchJSON(ctx, "stats_config", "/control/stats/config", &cfg)
+	if err == nil {
+		return &cfg, nil
+	}
+
+	var info struct {
+		Interval float64 `json:"interval"`
+	}
+	if infoErr := c.fetchJSON(ctx, "stats_config", "/control/stats_info", &info); infoErr != nil {
+		return nil, err
+	}
+	return &AdGuardStatsConfig{Enabled: info.Interval > 0, Interval: info.Interval * millisecondsPerDay}, nil
+}
+
+// BlockedServices reads the blocked services and their schedule. Versions
+// before v0.107.37 lack /control/blocked_services/get; their
+// /control/blocked_services/list is a bare list of IDs without a schedule. Only
+// a 404 from /get falls back to /list; any other error is returned as is.
+func (c *Client) BlockedServices(ctx context.Context) (*AdGuardBlockedServices, error) {
+	services, err := fetchAs[AdGuardBlockedServices](ctx, c, "blocked_services", "/control/blocked_services/get")
+	var se *statusError
+	if err == nil || !errors.As(err, &se) || se.code != http.StatusNotFound {
+		return services, err
+	}
+	var ids []string
+	if listErr := c.fetchJSON(ctx, "blocked_services", "/control/blocked_services/list", &ids); listErr != nil {
 		return nil, err
 	}
+	return &AdGuardBlockedServices{IDs: ids}, nil
+}
 
-	var logData AdGuardQueryLog
-	err = json.Unmarshal(body, &logData)
+func (c *Client) Clients(ctx context.Context) (*AdGuardClients, error) {
+	return fetchAs[AdGuardClients](ctx, c, "clients", "/control/clients")
+}
+
+func (c *Client) Rewrites(ctx context.Context) ([]AdGuardRewrite, error) {
+	rewrites, err := fetchAs[[]AdGuardRewrite](ctx, c, "rewrites", "/control/rewrite/list")
 	if err != nil {
-		logX("ERROR", "Failed to unmarshal querylog: %v", err)
 		return nil, err
 	}
+	return *rewrites, nil
+}
+
+// scheduleBlocking reports whether s lets blocked services be blocked at now,
+// i.e. now falls outside that weekday's pause range in the schedule's time zone.
+func scheduleBlocking(s *BlockedServicesSchedule, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	loc := time.Local
+	if s.TimeZone != "" && s.TimeZone != "Local" {
+		if l, err := time.LoadLocation(s.TimeZone); err == nil {
+			loc = l
+		} else {
+			logX("WARN", "Unknown blocked services schedule time zone %q, using local time", s.TimeZone)
+		}
+	}
+	t := now.In(loc)
+	day := [...]*DayRange{s.Sun, s.Mon, s.Tue, s.Wed, s.Thu, s.Fri, s.Sat}[t.Weekday()]
+	if day == nil {
+		return true
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	ms := t.Sub(midnight).Milliseconds()
+	return ms < day.Start || ms >= day.End
+}
+
+// SafeSearch returns whether safe search is enforced per service. Newer
+// AdGuard versions report a flag per service next to "enabled"; older ones only
+// have the single boolean, reported under the "global" service.
+func (c *Client) SafeSearch(ctx context.Context) (map[string]bool, error) {
+	var raw map[string]interface{}
+	if err := c.fetchJSON(ctx, "safesearch", "/control/safesearch/status", &raw); err != nil {
+		return nil, err
+	}
+	return safeSearchServices(raw), nil
+}
+
+func safeSearchServices(raw map[string]interface{}) map[string]bool {
+	enabled, _ := raw["enabled"].(bool)
+	services := map[string]bool{}
+	for name, v := range raw {
+		if on, ok := v.(bool); ok && name != "enabled" {
+			services[name] = enabled && on
+		}
+	}
+	if len(services) == 0 {
+		services["global"] = enabled
+	}
+	return services
+}
+
+// validResponseStatuses are the response_status filters accepted by /control/querylog.
+var validResponseStatuses = map[string]bool{
+	"all": true, "filtered": true, "blocked": true, "blocked_safebrowsing": true,
+	"blocked_parental": true, "whitelisted": true, "rewritten": true,
+	"safe_search": true, "processed": true,
+}
+
+// queryLogParams builds the querylog parameters from QUERYLOG_LIMIT,
+// QUERYLOG_SEARCH and QUERYLOG_RESPONSE_STATUS, forcing response_status=blocked
+// in BLOCKED_ONLY_MODE. Invalid values are ignored with a warning.
+func queryLogParams() url.Values {
+	params := url.Values{}
+	if raw := os.Getenv("QUERYLOG_LIMIT"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			params.Set("limit", raw)
+		} else {
+			logX("WARN", "Ignoring invalid QUERYLOG_LIMIT %q", raw)
+		}
+	}
+	if search := os.Getenv("QUERYLOG_SEARCH"); search != "" {
+		params.Set("search", search)
+	}
+	status := os.Getenv("QUERYLOG_RESPONSE_STATUS")
+	if blockedOnlyMode {
+		if status != "" && status != "blocked" {
+			logX("WARN", "BLOCKED_ONLY_MODE overrides QUERYLOG_RESPONSE_STATUS %q", status)
+		}
+		status = "blocked"
+	}
+	if status != "" {
+		if validResponseStatuses[status] {
+			params.Set("response_status", status)
+		} else {
+			logX("WARN", "Ignoring invalid QUERYLOG_RESPONSE_STATUS %q", status)
+		}
+	}
+	return params
+}
+
+// queryLogMaxPages returns QUERYLOG_MAX_PAGES, defaulting to a single page.
+func queryLogMaxPages() int {
+	n, err := strconv.Atoi(os.Getenv("QUERYLOG_MAX_PAGES"))
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// QueryLog fetches up to QUERYLOG_MAX_PAGES pages of the querylog, following
+// the "oldest" cursor of each page via older_than until AdGuard runs out of entries.
+func (c *Client) QueryLog(ctx context.Context) (*AdGuardQueryLog, error) {
+	logData, _, err := c.queryLogPages(ctx, queryLogParams(), time.Time{}, time.Time{})
+	return logData, err
+}
+
+// QueryLogWindow fetches the querylog entries logged in [start, end),
+// paginating back from end until a page reaches past start. It reports whether
+// QUERYLOG_MAX_PAGES stopped it first; the returned Oldest is then where the
+// unread rest of the window begins.
+func (c *Client) QueryLogWindow(ctx context.Context, start, end time.Time) (*AdGuardQueryLog, bool, error) {
+	params := queryLogParams()
+	params.Set("older_than", end.UTC().Format(time.RFC3339Nano))
+	return c.queryLogPages(ctx, params, start, end)
+}
+
+// queryLogPages paginates the querylog from params. A non-zero since/until
+// keeps only entries logged in [since, until) and stops once a page is older
+// than since; truncated reports that QUERYLOG_MAX_PAGES was reached first.
+func (c *Client) queryLogPages(ctx context.Context, params url.Values, since, until time.Time) (logData *AdGuardQueryLog, truncated bool, err error) {
+	windowed := !since.IsZero()
+	maxPages := queryLogMaxPages()
+
+	logData = &AdGuardQueryLog{}
+	pages := 0
+	truncated = true
+	for pages < maxPages {
+		path := "/control/querylog"
+		if len(params) > 0 {
+			path += "?" + params.Encode()
+		}
+		var page AdGuardQueryLog
+		if err := c.fetchJSON(ctx, "querylog", path, &page); err != nil {
+			return nil, false, err
+		}
+		pages++
+		if windowed {
+			for _, q := range page.Data {
+				t, err := time.Parse(time.RFC3339Nano, q.Time)
+				if err == nil && !t.Before(since) && t.Before(until) {
+					logData.Data = append(logData.Data, q)
+				}
+			}
+		} else {
+			logData.Data = append(logData.Data, page.Data...)
+		}
+		logData.Oldest = page.Oldest
+		if len(page.Data) == 0 || page.Oldest == "" {
+			truncated = false
+			break
+		}
+		if windowed {
+			if oldest, err := time.Parse(time.RFC3339Nano, page.Oldest); err != nil || oldest.Before(since) {
+				truncated = false
+				break
+			}
+		}
+		params.Set("older_than", page.Oldest)
+	}
+	queryLogPagesFetched.WithLabelValues(c.Host).Set(float64(pages))
+	if truncated && maxPages > 1 && !windowed {
+		logX("DEBUG", "Reached QUERYLOG_MAX_PAGES (%d) while paginating querylog", maxPages)
+	}
+
+	return logData, truncated && windowed, nil
+}
+
+// queryLogAlign aligns querylog fetches to SCRAPE_INTERVAL wall-clock
+// boundaries (QUERYLOG_ALIGN_WINDOWS) so consecutive scrapes count
+// non-overlapping windows.
+var queryLogAlign = false
+
+// lastWindowEnd is the end of the last querylog window counted per instance.
+var lastWindowEnd = map[string]time.Time{}
+
+// queryLogResume is the rest of a window that QUERYLOG_MAX_PAGES cut short:
+// the entries in [lastWindowEnd, Before) are still to be counted, after which
+// the window is complete up to End.
+type queryLogResume struct {
+	Before time.Time `json:"before"`
+	End    time.Time `json:"end"`
+}
+
+// queryLogResumes holds the unfinished window per instance.
+var queryLogResumes = map[string]queryLogResume{}
+
+// alignedWindow returns the querylog window to count at now: from the end of
+// the previous window up to the last scrapeInterval boundary. The first window
+// covers a single interval. start == end means there is nothing new to count.
+func alignedWindow(instance string, now time.Time) (start, end time.Time) {
+	end = now.Truncate(scrapeInterval)
+	start = lastWindowEnd[instance]
+	if start.IsZero() {
+		start = end.Add(-scrapeInterval)
+	}
+	if start.After(end) {
+		start = end
+	}
+	return start, end
+}
+
+// lastSeenQuery is the time of the newest querylog entry counted per instance
+// outside QUERYLOG_ALIGN_WINDOWS.
+var lastSeenQuery = map[string]time.Time{}
+
+// unseenEntries drops the entries an earlier scrape of instance already
+// counted, i.e. those logged at or before the newest entry it saw, and
+// advances lastSeenQuery. Entries without a parseable time can't be placed,
+// so they are skipped rather than counted again on every scrape that re-reads
+// them.
+func unseenEntries(instance string, entries []QueryLogEntry) []QueryLogEntry {
+	since := lastSeenQuery[instance]
+	newest := since
+	var fresh []QueryLogEntry
+	untimed := 0
+	for _, q := range entries {
+		t, err := time.Parse(time.RFC3339Nano, q.Time)
+		if err != nil {
+			untimed++
+			continue
+		}
+		if !t.After(since) {
+			continue
+		}
+		if t.After(newest) {
+			newest = t
+		}
+		fresh = append(fresh, q)
+	}
+	if untimed > 0 {
+		logX("DEBUG", "Skipped %d querylog entries without a parseable time from %s", untimed, instance)
+	}
+	lastSeenQuery[instance] = newest
+	return fresh
+}
+
+func updateQueryLogMetrics(ctx context.Context, c *Client) error {
+	instance := c.Host
+	var logData *AdGuardQueryLog
+	var err error
+	if queryLogAlign {
+		start, end := alignedWindow(instance, time.Now())
+		before := end
+		if r, ok := queryLogResumes[instance]; ok {
+			before, end = r.Before, r.End
+		}
+		var truncated bool
+		logData, truncated, err = c.QueryLogWindow(ctx, start, before)
+		if err == nil && truncated {
+			// Pages are read newest first, so what is left is the older part
+			// of the window; lastWindowEnd stays at its start until it has
+			// been read.
+			oldest, _ := time.Parse(time.RFC3339Nano, logData.Oldest)
+			lastWindowEnd[instance] = start
+			queryLogResumes[instance] = queryLogResume{Before: oldest, End: end}
+			queryLogTruncated.WithLabelValues(instance).Inc()
+			logKV("WARN", "QUERYLOG_MAX_PAGES reached before the start of the querylog window, the rest is counted next scrape",
+				"instance", instance, "window_start", start.Format(time.RFC3339), "resume_before", logData.Oldest)
+		} else if err == nil {
+			delete(queryLogResumes, instance)
+			lastWindowEnd[instance] = end
+		}
+	} else {
+		logData, err = c.QueryLog(ctx)
+		if err == nil {
+			logData.Data = unseenEntries(instance, logData.Data)
+		}
+	}
+	if err != nil {
+		logKV("ERROR", "Failed to fetch querylog", "instance", instance, "error", err)
+		return err
+	}
+	processQueryLog(instance, logData.Data)
+	queryLogEntriesProcessed.WithLabelValues(instance).Set(float64(len(logData.Data)))
+	queryLogEntries.WithLabelValues(instance).Add(float64(len(logData.Data)))
+	logX("DEBUG", "Processed %d querylog entries", len(logData.Data))
+	return nil
+}
+
+// knownRcodes bounds adguard_query_rcode_total; anything else is reported as "other".
+var knownRcodes = map[string]bool{
+	"NOERROR": true, "FORMERR": true, "SERVFAIL": true, "NXDOMAIN": true, "NOTIMP": true,
+	"REFUSED": true, "YXDOMAIN": true, "YXRRSET": true, "NXRRSET": true, "NOTAUTH": true, "NOTZONE": true,
+}
+
+// rcodeLabel maps a querylog status to a bounded rcode label, "unknown" when
+// AdGuard doesn't report one.
+func rcodeLabel(status string) string {
+	switch {
+	case status == "":
+		return "unknown"
+	case knownRcodes[strings.ToUpper(status)]:
+		return strings.ToUpper(status)
+	default:
+		return "other"
+	}
+}
+
+// knownProtos are the client protocols AdGuard reports in client_proto.
+var knownProtos = map[string]bool{"doh": true, "dot": true, "doq": true, "dnscrypt": true}
+
+// protoLabel maps a querylog client_proto to a bounded label. AdGuard leaves
+// it empty for plain DNS, which is also assumed for anything unrecognised.
+func protoLabel(proto string) string {
+	proto = strings.ToLower(proto)
+	if knownProtos[proto] {
+		return proto
+	}
+	return "plain"
+}
+
+// answerRecords extracts the type and value of each record in a querylog
+// answer, skipping entries that don't have the expected shape.
+func answerRecords(answer []interface{}) [][2]string {
+	var records [][2]string
+	for _, a := range answer {
+		m, ok := a.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		typ, _ := m["type"].(string)
+		value, _ := m["value"].(string)
+		if value != "" {
+			records = append(records, [2]string{typ, value})
+		}
+	}
+	return records
+}
+
+// topNLimit caps how many entries of each top list become series (TOP_N_LIMIT).
+// 0 keeps every entry AdGuard returns.
+var topNLimit = 25
+
+// flattenTop merges AdGuard's list of single-entry objects into one map.
+func flattenTop(list []map[string]float64) map[string]float64 {
+	values := map[string]float64{}
+	for _, m := range list {
+		for k, v := range m {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// topN returns the keys of the n highest values, highest first. Ties are
+// broken by key so the same input always yields the same series.
+func topN(values map[string]float64, n int) []string {
+	keys := sortedKeys(values)
+	sort.SliceStable(keys, func(i, j int) bool { return values[keys[i]] > values[keys[j]] })
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func updateStatsMetrics(instance string, stats *AdGuardStats) {
+	dnsQueries.WithLabelValues(instance).Set(stats.NumDNSQueries)
+	blockedFiltering.WithLabelValues(instance).Set(stats.NumBlockedFiltering)
+	replacedParental.WithLabelValues(instance).Set(stats.NumReplacedParental)
+	replacedSafebrowsing.WithLabelValues(instance).Set(stats.NumReplacedSafebrowsing)
+	replacedSafesearch.WithLabelValues(instance).Set(stats.NumReplacedSafesearch)
+	blockedAll.WithLabelValues(instance).Set(stats.NumBlockedFiltering + stats.NumReplacedSafebrowsing +
+		stats.NumReplacedSafesearch + stats.NumReplacedParental)
+	blockRatio.WithLabelValues(instance).Set(ratio(stats.NumBlockedFiltering, stats.NumDNSQueries))
+	avgProcessingTime.WithLabelValues(instance).Set(stats.AvgProcessingTime)
+
+	topQueriedDomains.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	queried := flattenTop(stats.TopQueriedDomains)
+	for _, domain := range topN(queried, topNLimit) {
+		topQueriedDomains.WithLabelValues(instance, sanitizeLabel(domain)).Set(queried[domain])
+	}
+	topBlockedDomains.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	blocked := flattenTop(stats.TopBlockedDomains)
+	for _, domain := range topN(blocked, topNLimit) {
+		topBlockedDomains.WithLabelValues(instance, sanitizeLabel(domain)).Set(blocked[domain])
+	}
+	topClients.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	clients := flattenTop(stats.TopClients)
+	for _, client := range topN(clients, topNLimit) {
+		topClients.WithLabelValues(instance, sanitizeLabel(client), sanitizeLabel(clientName(instance, client))).Set(clients[client])
+	}
+	topUpstreams.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	upstreamTotals := map[string]float64{}
+	for _, m := range stats.TopUpstream {
+		for up, val := range m {
+			upstreamTotals[upstreamLabel(up)] += val
+		}
+	}
+	for _, up := range topN(upstreamTotals, topNLimit) {
+		topUpstreams.WithLabelValues(instance, up).Set(upstreamTotals[up])
+	}
+	// top_upstreams_avg_time is already in seconds, like the metric.
+	topUpstreamTime.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	upstreamTimes := flattenTop(stats.TopUpstreamTime)
+	for _, up := range topN(upstreamTimes, topNLimit) {
+		topUpstreamTime.WithLabelValues(instance, sanitizeLabel(up)).Set(upstreamTimes[up])
+	}
+
+	logX("DEBUG", "Fetched stats: queries=%.0f blocked=%.0f replaced=%.0f avgTime=%.4fs topDomains=%d",
+		stats.NumDNSQueries,
+		stats.NumBlockedFiltering,
+		stats.NumReplacedParental,
+		stats.AvgProcessingTime,
+		len(stats.TopQueriedDomains),
+	)
+}
+
+// protectionStates is the protection state last seen per instance.
+var protectionStates = map[string]bool{}
+
+// recordProtectionChange sets adguard_protection_last_change_timestamp to now
+// when protection flips between scrapes. When the first scrape of instance
+// finds protection already off, e.g. after a restart, it is seeded with now
+// minus disabledFor. The timestamp keeps its last value while the state is
+// unchanged.
+func recordProtectionChange(instance string, enabled bool, disabledFor time.Duration, now time.Time) {
+	prev, seen := protectionStates[instance]
+	protectionStates[instance] = enabled
+	switch {
+	case seen && prev != enabled:
+		protectionLastChange.WithLabelValues(instance).Set(float64(now.Unix()))
+	case !seen && !enabled:
+		protectionLastChange.WithLabelValues(instance).Set(float64(now.Add(-disabledFor).Unix()))
+	}
+}
+
+// disabledReason reports why protection is off. Without an explicit reason from
+// the API, a pending protection_disabled_duration means a timed pause ("Disable
+// for 10 minutes"), otherwise protection was turned off manually until further notice.
+func disabledReason(status *AdGuardStatus) string {
+	switch {
+	case status.ProtectionDisabledReason != "":
+		return status.ProtectionDisabledReason
+	case status.ProtectionDisabledDuration > 0:
+		return "timed"
+	default:
+		return "manual"
+	}
+}
+
+func updateStatusMetrics(instance string, status *AdGuardStatus) {
+	statusProtectionEnabled.WithLabelValues(instance).Set(boolToFloat(status.ProtectionEnabled))
+	protectionStatus.WithLabelValues(instance, "enabled").Set(boolToFloat(status.ProtectionEnabled))
+	protectionStatus.WithLabelValues(instance, "disabled").Set(boolToFloat(!status.ProtectionEnabled))
+	statusRunning.WithLabelValues(instance).Set(boolToFloat(status.Running))
+	statusDHCPAvailable.WithLabelValues(instance).Set(boolToFloat(status.DHCPAvailable))
+	statusDisabledDuration.WithLabelValues(instance).Set(float64(status.ProtectionDisabledDuration))
+	statusDNSPort.WithLabelValues(instance).Set(float64(status.DNSPort))
+	statusHTTPPort.WithLabelValues(instance).Set(float64(status.HTTPPort))
+	statusDNSAddresses.WithLabelValues(instance).Set(float64(len(status.DNSAddresses)))
+	versionInfo.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	versionInfo.WithLabelValues(instance, status.Version).Set(1)
+	recordProtectionChange(instance, status.ProtectionEnabled, time.Duration(status.ProtectionDisabledDuration)*time.Millisecond, time.Now())
+	protectionDisabledReason.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	if !status.ProtectionEnabled {
+		protectionDisabledReason.WithLabelValues(instance, disabledReason(status)).Set(1)
+	}
+
+	logX("DEBUG", "Fetched status: running=%t protection=%t DHCP=%t version=%s",
+		status.Running, status.ProtectionEnabled, status.DHCPAvailable, status.Version)
+}
+
+func updateSafeSearchMetrics(instance string, services map[string]bool) {
+	safeSearchEnabled.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	for service, on := range services {
+		safeSearchEnabled.WithLabelValues(instance, service).Set(boolToFloat(on))
+	}
+}
+
+func updateBlockedServicesMetrics(instance string, services *AdGuardBlockedServices) {
+	blockedServicesScheduleActive.WithLabelValues(instance).Set(boolToFloat(scheduleBlocking(services.Schedule, time.Now())))
+	blockedServiceEnabled.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	for _, id := range services.IDs {
+		blockedServiceEnabled.WithLabelValues(instance, sanitizeLabel(id)).Set(1)
+	}
+}
+
+func updateClientMetrics(instance string, clients *AdGuardClients) {
+	for _, vec := range []*prometheus.GaugeVec{clientInfo, clientFilteringEnabled, clientParentalEnabled, clientSafeBrowsingEnabled, clientGlobalSettings} {
+		vec.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	}
+	for _, c := range clients.Clients {
+		name := sanitizeLabel(c.Name)
+		clientInfo.WithLabelValues(instance, name, sanitizeLabel(strings.Join(c.IDs, ","))).Set(1)
+		clientFilteringEnabled.WithLabelValues(instance, name).Set(boolToFloat(c.FilteringEnabled))
+		clientParentalEnabled.WithLabelValues(instance, name).Set(boolToFloat(c.ParentalEnabled))
+		clientSafeBrowsingEnabled.WithLabelValues(instance, name).Set(boolToFloat(c.SafeBrowsingEnabled))
+		clientGlobalSettings.WithLabelValues(instance, name).Set(boolToFloat(c.UseGlobalSettings))
+	}
+}
+
+func updateRewriteMetrics(instance string, rewrites []AdGuardRewrite) {
+	dnsRewrites.WithLabelValues(instance).Set(float64(len(rewrites)))
+	dnsRewriteInfo.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	for _, r := range rewrites {
+		dnsRewriteInfo.WithLabelValues(instance, sanitizeLabel(r.Domain), sanitizeLabel(r.Answer)).Set(1)
+	}
+}
+
+func updateStatsConfigMetrics(instance string, cfg *AdGuardStatsConfig) {
+	statsEnabled.WithLabelValues(instance).Set(boolToFloat(cfg.Enabled))
+	statsRetentionDays.WithLabelValues(instance).Set(cfg.Interval / millisecondsPerDay)
+	statsIntervalSeconds.WithLabelValues(instance).Set(cfg.Interval / 1000)
+}
+
+// updateReplicaMetrics compares the primary's stats with the paired replica's.
+func updateReplicaMetrics(ctx context.Context, replicaClient *Client, instance string, primary *AdGuardStats) {
+	replica, err := replicaClient.ReplicaStats(ctx)
+	if err != nil {
+		logX("WARN", "Failed to fetch replica stats: %v", err)
+		return
+	}
+	replicaQueryLag.WithLabelValues(instance).Set(primary.NumDNSQueries - replica.NumDNSQueries)
+}
+
+func updateDHCPMetrics(instance string, dhcp *AdGuardDHCP) {
+	dhcpLeaseExpiry.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	dhcpEnabled.WithLabelValues(instance).Set(boolToFloat(dhcp.Enabled))
+	// Without a configured DHCP server AdGuard answers with an empty
+	// object; leave the lease counts out rather than reporting zeros.
+	if !dhcp.Enabled && len(dhcp.Leases) == 0 && len(dhcp.StaticLeases) == 0 {
+		dhcpLeases.DeleteLabelValues(instance)
+		dhcpStaticLeases.DeleteLabelValues(instance)
+		logX("DEBUG", "DHCP is not configured on %s", instance)
+		return
+	}
+	dhcpLeases.WithLabelValues(instance).Set(float64(len(dhcp.Leases)))
+	dhcpStaticLeases.WithLabelValues(instance).Set(float64(len(dhcp.StaticLeases)))
+	for _, l := range dhcp.Leases {
+		expires, err := time.Parse(time.RFC3339, l.Expires)
+		if err != nil {
+			logX("WARN", "Failed to parse expiry %q of DHCP lease %s: %v", l.Expires, l.IP, err)
+			continue
+		}
+		dhcpLeaseExpiry.WithLabelValues(instance, l.IP, l.MAC).Set(float64(expires.Unix()))
+	}
+	for _, l := range dhcp.StaticLeases {
+		dhcpLeaseExpiry.WithLabelValues(instance, l.IP, l.MAC).Set(0)
+	}
+}
+
+func updateFilteringMetrics(instance string, filtering *AdGuardFiltering) {
+	for _, vec := range []*prometheus.GaugeVec{filterRulesCount, filterEnabled, filterLastUpdated} {
+		vec.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	}
+	for list, filters := range map[string][]AdGuardFilter{
+		"blocklist": filtering.Filters,
+		"allowlist": filtering.WhitelistFilters,
+	} {
+		enabled := 0
+		for _, f := range filters {
+			if f.Enabled {
+				enabled++
+			}
+			name := sanitizeLabel(f.Name)
+			filterRulesCount.WithLabelValues(instance, list, name, sanitizeLabel(f.URL)).Set(float64(f.RulesCount))
+			filterEnabled.WithLabelValues(instance, list, name).Set(boolToFloat(f.Enabled))
+			// Lists that were never downloaded have no last_updated.
+			if f.LastUpdated == "" {
+				continue
+			}
+			updated, err := time.Parse(time.RFC3339, f.LastUpdated)
+			if err != nil {
+				logX("WARN", "Failed to parse last_updated %q of filter %s: %v", f.LastUpdated, f.Name, err)
+				continue
+			}
+			filterLastUpdated.WithLabelValues(instance, list, name).Set(float64(updated.Unix()))
+		}
+		filtersTotal.WithLabelValues(instance, list).Set(float64(len(filters)))
+		filtersEnabled.WithLabelValues(instance, list).Set(float64(enabled))
+	}
+}
+
+func updateMetrics(ctx context.Context) {
+	scrapeID.Store(newScrapeID())
+	defer scrapeID.Store("")
+	resetRetryBudget()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		updateCycleDuration.Set(elapsed.Seconds())
+		if elapsed > scrapeInterval {
+			logX("WARN", "Update cycle took %s, longer than SCRAPE_INTERVAL (%s)", elapsed, scrapeInterval)
+		}
+	}()
+
+	// Instances are scraped one after another; an unreachable one only
+	// fails its own fetches.
+	success := true
+	set := currentClients()
+	for i, c := range set.instances {
+		if loginPending(c.Host) {
+			logKV("DEBUG", "Skipping instance until its startup login finishes", "instance", c.Host)
+			success = false
+			continue
+		}
+		var replica *Client
+		if i == 0 {
+			replica = set.replica
+		}
+		if !updateInstance(ctx, c, replica) {
+			success = false
+		}
+	}
+
+	history.record(success)
+	scrapeSuccessRatio.Set(history.ratio())
+	if success {
+		ready.Store(true)
+	}
+}
+
+// updateInstance refreshes the metrics of one AdGuard instance and reports
+// whether its required endpoints succeeded. A non-nil replica, the
+// ADGUARD_REPLICA_HOST client, is compared with it.
+func updateInstance(ctx context.Context, c *Client, replica *Client) bool {
+	instance := c.Host
+	// The clients are fetched first so the stats below can name the top
+	// clients from the same response, and only once per CLIENT_NAME_TTL.
+	if !clientNamesFresh(instance) {
+		if clients, err := c.Clients(ctx); err != nil {
+			logKV("WARN", "Failed to fetch clients", "instance", instance, "error", err)
+			rememberClientNames(instance, nil)
+		} else {
+			updateClientMetrics(instance, clients)
+			rememberClientNames(instance, clients)
+		}
+	}
+
+	// The three core endpoints are fetched concurrently, so a slow one
+	// delays the cycle by its own latency rather than the sum. Each
+	// goroutine owns the metrics it repopulates, so the Reset-and-refill
+	// of one never interleaves with another's.
+	var statsOK, statusOK, queryLogOK bool
+	var wg sync.WaitGroup
+	wg.Add(3)
+	scrapeGoroutines.Add(3)
+	go func() {
+		defer wg.Done()
+		defer scrapeGoroutines.Dec()
+		stats, err := c.Stats(ctx)
+		recordEndpoint(instance, "stats", err)
+		if err != nil {
+			logKV("ERROR", "Failed to fetch stats", "instance", instance, "error", err)
+			return
+		}
+		updateStatsMetrics(instance, stats)
+		if replica != nil {
+			updateReplicaMetrics(ctx, replica, instance, stats)
+		}
+		statsOK = true
+	}()
+	go func() {
+		defer wg.Done()
+		defer scrapeGoroutines.Dec()
+		status, err := c.Status(ctx)
+		recordEndpoint(instance, "status", err)
+		if err != nil {
+			logKV("ERROR", "Failed to fetch status", "instance", instance, "error", err)
+			return
+		}
+		updateStatusMetrics(instance, status)
+		statusOK = true
+	}()
+	go func() {
+		defer wg.Done()
+		defer scrapeGoroutines.Dec()
+		if !queryLogEnabled {
+			queryLogOK = true
+			return
+		}
+		err := updateQueryLogMetrics(ctx, c)
+		recordEndpoint(instance, "querylog", err)
+		queryLogOK = err == nil
+	}()
+	wg.Wait()
+	success := statsOK && statusOK && queryLogOK
+
+	if dhcp, err := c.DHCP(ctx); err != nil {
+		logKV("WARN", "Failed to fetch DHCP status", "instance", instance, "error", err)
+	} else {
+		updateDHCPMetrics(instance, dhcp)
+	}
+
+	if filtering, err := c.Filtering(ctx); err != nil {
+		logKV("WARN", "Failed to fetch filtering status", "instance", instance, "error", err)
+	} else {
+		updateFilteringMetrics(instance, filtering)
+	}
 
-	return &logData, nil
-}
-
-func updateQueryLogMetrics() {
-        logData, err := fetchQueryLog()
-        if err != nil {
-                logX("ERROR", "Failed to fetch querylog: %v", err)
-                return
-        }
-        for _, q := range logData.Data {
-                queryCountByReason.WithLabelValues(q.Reason).Inc()
-                queryCountByType.WithLabelValues(q.Question.Type).Inc()
-                elapsedMs, err := strconv.ParseFloat(q.Elapsed, 64)
-                if err == nil {
-	            queryHistogramByClient.WithLabelValues(q.Client).Observe(elapsedMs)
-                } else {
-	            logX("WARN", "Failed to parse elapsedMs: %v", err)
-}
-                queryCountByUpstream.WithLabelValues(q.Upstream).Inc()
-                queryCountByDomain.WithLabelValues(q.Question.Name).Inc()
-                queryCountClientReason.WithLabelValues(q.Client, q.Reason).Inc()
-        }
-        logX("DEBUG", "Processed %d querylog entries", len(logData.Data))
-}
-
-func updateMetrics() {
-        stats, err := fetchStats()
-        if err == nil {
-                dnsQueries.Set(stats.NumDNSQueries)
-                blockedFiltering.Set(stats.NumBlockedFiltering)
-                replacedParental.Set(stats.NumReplacedParental)
-                avgProcessingTime.Set(stats.AvgProcessingTime)
-
-                topQueriedDomains.Reset()
-                for _, m := range stats.TopQueriedDomains {
-                        for domain, val := range m {
-                                topQueriedDomains.WithLabelValues(domain).Set(val)
-                        }
-                }
-                topBlockedDomains.Reset()
-                for _, m := range stats.TopBlockedDomains {
-                        for domain, val := range m {
-                                topBlockedDomains.WithLabelValues(domain).Set(val)
-                        }
-                }
-                topClients.Reset()
-                for _, m := range stats.TopClients {
-                        for client, val := range m {
-                                topClients.WithLabelValues(client).Set(val)
-                        }
-                }
-                topUpstreams.Reset()
-                for _, m := range stats.TopUpstream {
-                        for up, val := range m {
-                                topUpstreams.WithLabelValues(up).Set(val)
-                        }
-                }
-                topUpstreamTime.Reset()
-                for _, m := range stats.TopUpstreamTime {
-                        for up, val := range m {
-                                topUpstreamTime.WithLabelValues(up).Set(val)
-                        }
-                }
-
-                logX("DEBUG", "Fetched stats: queries=%.0f blocked=%.0f replaced=%.0f avgTime=%.2fms topDomains=%d",
-                        stats.NumDNSQueries,
-                        stats.NumBlockedFiltering,
-                        stats.NumReplacedParental,
-                        stats.AvgProcessingTime,
-                        len(stats.TopQueriedDomains),
-                )
-        }
-
-        status, err := fetchStatus()
-        if err == nil {
-                statusProtectionEnabled.Set(boolToFloat(status.ProtectionEnabled))
-                statusRunning.Set(boolToFloat(status.Running))
-                statusDHCPAvailable.Set(boolToFloat(status.DHCPAvailable))
-                statusDisabledDuration.Set(float64(status.ProtectionDisabledDuration))
-                versionInfo.Reset()
-                versionInfo.WithLabelValues(status.Version).Set(1)
-
-                logX("DEBUG", "Fetched status: running=%t protection=%t DHCP=%t version=%s",
-                        status.Running, status.ProtectionEnabled, status.DHCPAvailable, status.Version)
-        }
-
-        updateQueryLogMetrics()
+	if services, err := c.BlockedServices(ctx); err != nil {
+		logKV("WARN", "Failed to fetch blocked services schedule", "instance", instance, "error", err)
+	} else {
+		updateBlockedServicesMetrics(instance, services)
+	}
+
+	if rewrites, err := c.Rewrites(ctx); err != nil {
+		logKV("WARN", "Failed to fetch DNS rewrites", "instance", instance, "error", err)
+	} else {
+		updateRewriteMetrics(instance, rewrites)
+	}
+
+	if cfg, err := c.StatsConfig(ctx); err != nil {
+		logKV("WARN", "Failed to fetch stats config", "instance", instance, "error", err)
+	} else {
+		updateStatsConfigMetrics(instance, cfg)
+	}
+
+	if services, err := c.SafeSearch(ctx); err != nil {
+		logKV("WARN", "Failed to fetch safesearch status", "instance", instance, "error", err)
+	} else {
+		updateSafeSearchMetrics(instance, services)
+	}
+
+	adguardUp.WithLabelValues(instance).Set(boolToFloat(success))
+	return success
+}
+
+// recordEndpoint reports the outcome of a request to one of the core
+// endpoints in adguard_endpoint_up and adguard_scrape_errors_total.
+func recordEndpoint(instance, endpoint string, err error) {
+	endpointUp.WithLabelValues(instance, endpoint).Set(boolToFloat(err == nil))
+	if err != nil {
+		scrapeErrors.WithLabelValues(instance, endpoint).Inc()
+	}
+}
+
+// envSeconds reads a duration in whole seconds from name, falling back to def.
+func envSeconds(name string, def int) time.Duration {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n < 1 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// newServer builds the exporter's HTTP server with read/write/idle timeouts so
+// slow clients can't hold connections open indefinitely.
+func newServer(addr string, handler http.Handler) *http.Server {
+	readTimeout := envSeconds("HTTP_READ_TIMEOUT", 10)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readTimeout,
+		WriteTimeout:      envSeconds("HTTP_WRITE_TIMEOUT", 30),
+		IdleTimeout:       envSeconds("HTTP_IDLE_TIMEOUT", 60),
+	}
+}
+
+// instrumentHandler wraps h so its requests are counted and timed under path.
+func instrumentHandler(path string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"path": path}
+	return promhttp.InstrumentHandlerCounter(httpRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels), h))
+}
+
+// requireBasicAuth wraps h so it only answers requests carrying user and pass.
+// Both are hashed before the constant-time comparison so their lengths don't
+// leak either. An empty user disables the check.
+func requireBasicAuth(user, pass string, h http.Handler) http.Handler {
+	if user == "" {
+		return h
+	}
+	wantUser, wantPass := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(pass))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		gotUser, gotPass := sha256.Sum256([]byte(u)), sha256.Sum256([]byte(p))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+		if !ok || userOK&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="adguard-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdownTimeout bounds how long a SIGINT/SIGTERM waits for open requests
+// and the running scrape, well within Docker's default 10s stop grace period.
+const shutdownTimeout = 5 * time.Second
+
+// runScrapeLoop calls scrape on a fixed interval until ctx is cancelled. A
+// tick that arrives while the previous scrape is still running is skipped and
+// counted in adguard_scrape_overruns_total, so slow scrapes never pile up.
+// Scrapes run with ctx, so cancelling it aborts their AdGuard requests; the
+// loop still waits for a running scrape to return.
+func runScrapeLoop(ctx context.Context, interval time.Duration, scrape func(context.Context)) {
+	var running atomic.Bool
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	start := func() {
+		if !running.CompareAndSwap(false, true) {
+			scrapeOverruns.Inc()
+			logX("WARN", "Previous scrape still running after SCRAPE_INTERVAL (%s), skipping this tick", interval)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer running.Store(false)
+			scrape(ctx)
+		}()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start()
+		}
+	}
+}
+
+// serve runs srv on ln until ctx is cancelled, then shuts it down gracefully,
+// giving open requests up to shutdownTimeout to complete.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, useTLS bool) error {
+	errc := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	logX("INFO", "Shutting down exporter ..")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
 
 func main() {
-        scrapeIntervalStr := os.Getenv("SCRAPE_INTERVAL")
-        port := os.Getenv("EXPORTER_PORT")
-        if port == "" {
-                port = "9617"
-        }
-        interval, err := strconv.Atoi(scrapeIntervalStr)
-        if err != nil || interval < 1 {
-                interval = 15
-        }
-
-        go func() {
-                for {
-                        updateMetrics()
-                        time.Sleep(time.Duration(interval) * time.Second)
-                }
-        }()
-
-        http.Handle("/metrics", promhttp.Handler())
-        logX("INFO", "Starting exporter at :%s ..", port)
-        err = http.ListenAndServe(":"+port, nil)
-        if err != nil {
-                logX("ERROR", "Server failed: %v", err)
-                os.Exit(1)
-        }
+	if configFileErr != nil {
+		logX("ERROR", "Invalid CONFIG_FILE: %v", configFileErr)
+		os.Exit(1)
+	}
+	if err := validateConfig(); err != nil {
+		logX("ERROR", "Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	logX("INFO", "adguard-exporter %s (commit %s, built %s, %s)", version, commit, buildDate, runtime.Version())
+	scrapeIntervalStr := os.Getenv("SCRAPE_INTERVAL")
+	port := os.Getenv("EXPORTER_PORT")
+	if port == "" {
+		port = "9617"
+	}
+	interval, err := strconv.Atoi(scrapeIntervalStr)
+	if err != nil || interval < 1 {
+		interval = 15
+	}
+	scrapeInterval = time.Duration(interval) * time.Second
+	checkScrapeInterval(scrapeInterval)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go runReloader(ctx, hup)
+
+	if stateFile := os.Getenv("STATE_FILE"); stateFile != "" {
+		if err := loadState(stateFile); err != nil {
+			logX("WARN", "Ignoring unreadable state file %s, starting fresh: %v", stateFile, err)
+		}
+	}
+
+	loginRetries, err := strconv.Atoi(os.Getenv("LOGIN_RETRIES"))
+	if err != nil || loginRetries < 0 {
+		loginRetries = 5
+	}
+	startLogins(ctx, reloadClients().instances, loginRetries, envSeconds("LOGIN_RETRY_INTERVAL", 2))
+
+	scrapeDone := make(chan struct{})
+	if onDemandScrape {
+		logX("INFO", "SCRAPE_MODE=ondemand, fetching from AdGuard on each /metrics request")
+		close(scrapeDone)
+	} else {
+		go func() {
+			defer close(scrapeDone)
+			runScrapeLoop(ctx, scrapeInterval, scrapeOnce)
+		}()
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("DEBUG_DUMP_INTERVAL")); err == nil && n > 0 {
+		go runDebugDump(time.Duration(n)*time.Second, ctx.Done())
+	}
+
+	authUser, authPass := envOrFile("EXPORTER_AUTH_USER"), envOrFile("EXPORTER_AUTH_PASS")
+	if authUser != "" {
+		logX("INFO", "Requiring basic auth for /metrics")
+	}
+	metricsHandler := promhttp.Handler()
+	if exemplarsEnabled {
+		metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	}
+	if onDemandScrape {
+		metricsHandler = onDemand.cancelOnAbort(metricsHandler)
+	}
+	path := metricsPath(os.Getenv("METRICS_PATH"))
+	registerRoutes(http.DefaultServeMux, path, instrumentHandler(path, requireBasicAuth(authUser, authPass, metricsHandler)))
+	if currentLogLevel.Load() >= logLevelMap["DEBUG"] {
+		http.Handle("/debug/metrics", instrumentHandler("/debug/metrics", requireBasicAuth(authUser, authPass, debugMetricsHandler(prometheus.DefaultGatherer))))
+		logX("DEBUG", "Serving metrics debug page at /debug/metrics")
+	}
+	server := newServer(":"+port, nil)
+	certFile, keyFile := os.Getenv("EXPORTER_TLS_CERT"), os.Getenv("EXPORTER_TLS_KEY")
+	useTLS := certFile != "" && keyFile != ""
+	if useTLS {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			logX("ERROR", "Failed to load TLS certificate: %v", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = reloader.tlsConfig()
+	}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logX("ERROR", "Server failed: %v", err)
+		os.Exit(1)
+	}
+	if useTLS {
+		logX("INFO", "Starting exporter with TLS at :%s%s ..", port, path)
+	} else {
+		logX("INFO", "Starting exporter at :%s%s ..", port, path)
+	}
+	if err := serve(ctx, server, ln, useTLS); err != nil {
+		logX("ERROR", "Server failed: %v", err)
+		os.Exit(1)
+	}
+
+	// Let an in-flight scrape finish so STATE_FILE holds its counts.
+	select {
+	case <-scrapeDone:
+	case <-time.After(shutdownTimeout):
+		logX("WARN", "Scrape still running after %s, exiting anyway", shutdownTimeout)
+	}
+	logX("INFO", "Shutdown complete")
 }
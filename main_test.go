@@ -1,6 +1,39 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMain shortens the retry backoff so tests against failing fake AdGuard
+// servers don't sleep through real delays.
+func TestMain(m *testing.M) {
+	retryBackoff = time.Millisecond
+	os.Exit(m.Run())
+}
 
 func TestBoolToFloat(t *testing.T) {
 	tests := []struct {
@@ -18,3 +51,2131 @@ func TestBoolToFloat(t *testing.T) {
 		}
 	}
 }
+
+func TestScrapeHistoryRatio(t *testing.T) {
+	h := newScrapeHistory(4)
+	if r := h.ratio(); r != 0 {
+		t.Errorf("Expected 0 for empty history, got %v", r)
+	}
+
+	steps := []struct {
+		success  bool
+		expected float64
+	}{
+		{true, 1.0},
+		{false, 0.5},
+		{true, 2.0 / 3.0},
+		{true, 0.75},
+		{false, 0.5},  // evicts the first success
+		{false, 0.5},  // evicts the first failure
+		{false, 0.25}, // evicts a success
+	}
+
+	for i, s := range steps {
+		h.record(s.success)
+		if r := h.ratio(); r != s.expected {
+			t.Errorf("step %d: expected %v, got %v", i, s.expected, r)
+		}
+	}
+}
+
+func TestFetchQueryLogSendsFilterParams(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		got = map[string]string{"search": q.Get("search"), "response_status": q.Get("response_status"), "limit": q.Get("limit")}
+		w.Write([]byte(`{"data":[]}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("QUERYLOG_SEARCH", "example.com")
+	t.Setenv("QUERYLOG_RESPONSE_STATUS", "blocked")
+	t.Setenv("QUERYLOG_LIMIT", "1000")
+
+	if _, err := NewClient(target{Host: srv.URL}).QueryLog(context.Background()); err != nil {
+		t.Fatalf("QueryLog failed: %v", err)
+	}
+	if got["search"] != "example.com" || got["response_status"] != "blocked" || got["limit"] != "1000" {
+		t.Errorf("Unexpected query params: %v", got)
+	}
+
+	t.Setenv("QUERYLOG_LIMIT", "-1")
+	if _, err := NewClient(target{Host: srv.URL}).QueryLog(context.Background()); err != nil {
+		t.Fatalf("QueryLog failed: %v", err)
+	}
+	if got["limit"] != "" {
+		t.Errorf("Expected invalid limit to be dropped, got %q", got["limit"])
+	}
+
+	t.Setenv("QUERYLOG_RESPONSE_STATUS", "bogus")
+	if _, err := NewClient(target{Host: srv.URL}).QueryLog(context.Background()); err != nil {
+		t.Fatalf("QueryLog failed: %v", err)
+	}
+	if got["response_status"] != "" {
+		t.Errorf("Expected invalid response_status to be dropped, got %q", got["response_status"])
+	}
+}
+
+func TestBlockedOnlyModeRequestsBlockedEntries(t *testing.T) {
+	var status string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status = r.URL.Query().Get("response_status")
+		w.Write([]byte(`{"data":[{"question":{"type":"A","name":"ads.example.com"},"client":"10.0.0.9","reason":"FilteredBlackList","upstream":"blocked-only-upstream","time":"2025-06-18T08:00:00Z"}]}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("QUERYLOG_RESPONSE_STATUS", "processed")
+	defer func(b bool) { blockedOnlyMode = b }(blockedOnlyMode)
+	blockedOnlyMode = true
+
+	reasonBefore := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList"))
+	upstreamBefore := testutil.ToFloat64(queryCountByUpstream.WithLabelValues(srv.URL, "blocked-only-upstream"))
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+	if status != "blocked" {
+		t.Errorf("Expected response_status=blocked, got %q", status)
+	}
+	if got := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList")) - reasonBefore; got != 1 {
+		t.Errorf("Expected blocked reason count to grow by 1, got %v", got)
+	}
+	if got := testutil.ToFloat64(queryCountByUpstream.WithLabelValues(srv.URL, "blocked-only-upstream")) - upstreamBefore; got != 0 {
+		t.Errorf("Expected upstream counter to be left alone in blocked-only mode, got %v", got)
+	}
+}
+
+func TestBlockedOnlyModeSeries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[{"question":{"type":"A","name":"ads.example.com"},"client":"10.0.0.9",
+			"reason":"FilteredBlackList","rules":[{"filter_list_id":3,"text":"||ads.example.com^"}],"elapsedMs":"0.1","time":"2025-06-18T08:00:00Z"}]}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	defer func(b bool) { blockedOnlyMode = b }(blockedOnlyMode)
+	blockedOnlyMode = true
+
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	present := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "instance" && lp.GetValue() == srv.URL {
+					present[mf.GetName()] = true
+				}
+			}
+		}
+	}
+	for _, name := range []string{"adguard_query_reason_total", "adguard_query_client_reason_total", "adguard_query_blocked_by_filter_total"} {
+		if !present[name] {
+			t.Errorf("Expected %s in blocked-only mode", name)
+		}
+	}
+	for _, name := range []string{"adguard_query_type_total", "adguard_query_domain_total", "adguard_query_tld_total", "adguard_query_upstream_total", "adguard_cache_hit_ratio"} {
+		if present[name] {
+			t.Errorf("Expected no %s series in blocked-only mode", name)
+		}
+	}
+}
+
+func TestEndpointCredentialOverride(t *testing.T) {
+	creds := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		creds[r.URL.Path] = user + ":" + pass
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("ADGUARD_PASS", "global")
+	t.Setenv("STATS_USER", "stats")
+	t.Setenv("STATS_PASS", "secret")
+
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if _, err := NewClient(target{Host: srv.URL}).Status(context.Background()); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+
+	if got := creds["/control/stats"]; got != "stats:secret" {
+		t.Errorf("Expected stats override credentials, got %q", got)
+	}
+	if got := creds["/control/status"]; got != "admin:global" {
+		t.Errorf("Expected global credentials for status, got %q", got)
+	}
+}
+
+func TestCredentialsFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	userFile, passFile := filepath.Join(dir, "user"), filepath.Join(dir, "pass")
+	os.WriteFile(userFile, []byte("admin\n"), 0o600)
+	os.WriteFile(passFile, []byte("s3cret\r\n"), 0o600)
+	t.Setenv("ADGUARD_HOST", "http://adguard:3000")
+	t.Setenv("ADGUARD_USER", "")
+	t.Setenv("ADGUARD_PASS", "")
+	t.Setenv("ADGUARD_USER_FILE", userFile)
+	t.Setenv("ADGUARD_PASS_FILE", passFile)
+
+	if user, pass := NewClient(target{Host: "http://adguard:3000"}).credentials("stats"); user != "admin" || pass != "s3cret" {
+		t.Errorf("Expected credentials from files without trailing newlines, got %q/%q", user, pass)
+	}
+
+	t.Setenv("ADGUARD_PASS", "from-env")
+	if _, pass := NewClient(target{Host: "http://adguard:3000"}).credentials("stats"); pass != "from-env" {
+		t.Errorf("Expected ADGUARD_PASS to win over ADGUARD_PASS_FILE, got %q", pass)
+	}
+
+	t.Setenv("ADGUARD_PASS", "")
+	t.Setenv("ADGUARD_PASS_FILE", filepath.Join(dir, "missing"))
+	if _, pass := NewClient(target{Host: "http://adguard:3000"}).credentials("stats"); pass != "" {
+		t.Errorf("Expected an unreadable file to yield no password, got %q", pass)
+	}
+}
+
+func TestRewriteHits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":[
+			{"question":{"type":"A","name":"nas.home.lan"},"reason":"Rewrite","client":"10.0.0.2","elapsedMs":"0.1","time":"2025-06-18T08:00:04Z"},
+			{"question":{"type":"A","name":"nas.home.lan"},"reason":"RewriteRule","client":"10.0.0.3","elapsedMs":"0.1","time":"2025-06-18T08:00:03Z"},
+			{"question":{"type":"A","name":"printer.home.lan"},"reason":"RewriteEtcHosts","client":"10.0.0.2","elapsedMs":"0.1","time":"2025-06-18T08:00:02Z"},
+			{"question":{"type":"A","name":"example.org"},"reason":"NotFilteredNotFound","client":"10.0.0.2","elapsedMs":"3.2","time":"2025-06-18T08:00:01Z"}
+		]}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	expected := map[string]float64{"nas.home.lan": 2, "printer.home.lan": 1, "example.org": 0}
+	before := map[string]float64{}
+	for domain := range expected {
+		before[domain] = testutil.ToFloat64(rewriteHits.WithLabelValues(srv.URL, domain))
+	}
+
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+
+	for domain, want := range expected {
+		if got := testutil.ToFloat64(rewriteHits.WithLabelValues(srv.URL, domain)) - before[domain]; got != want {
+			t.Errorf("Expected %v rewrite hits for %s, got %v", want, domain, got)
+		}
+	}
+}
+
+func TestQueryLogEntriesProcessed(t *testing.T) {
+	const n = 37
+	var entries []string
+	base := time.Date(2025, 6, 18, 8, 0, 0, 0, time.UTC)
+	for i := n; i > 0; i-- {
+		entries = append(entries, fmt.Sprintf(`{"question":{"type":"A","name":"e%d.example"},"reason":"NotFilteredNotFound","time":%q}`,
+			i, base.Add(time.Duration(i)*time.Second).Format(time.RFC3339)))
+	}
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/querylog": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"data":[` + strings.Join(entries, ",") + `]}`))
+		},
+	})
+
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+	if got := testutil.ToFloat64(queryLogEntriesProcessed.WithLabelValues(srv.URL)); got != n {
+		t.Errorf("Expected %d entries processed, got %v", n, got)
+	}
+
+	// The same page again holds nothing new.
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+	if got := testutil.ToFloat64(queryLogEntriesProcessed.WithLabelValues(srv.URL)); got != 0 {
+		t.Errorf("Expected no entries processed for a repeated page, got %v", got)
+	}
+	if got := testutil.ToFloat64(queryLogEntries.WithLabelValues(srv.URL)); got != n {
+		t.Errorf("Expected %d entries in total, got %v", n, got)
+	}
+}
+
+func TestQueryLogOverlappingPagesCountedOnce(t *testing.T) {
+	pages := []string{
+		`{"data":[
+			{"question":{"type":"A","name":"b.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:02Z"},
+			{"question":{"type":"A","name":"a.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:01Z"}
+		]}`,
+		`{"data":[
+			{"question":{"type":"A","name":"d.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:04Z"},
+			{"question":{"type":"A","name":"c.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:03Z"},
+			{"question":{"type":"A","name":"b.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:02Z"}
+		]}`,
+		`{"data":[
+			{"question":{"type":"A","name":"d.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:04Z"}
+		]}`,
+	}
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(pages[fetches]))
+		fetches++
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	before := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList"))
+	for range pages {
+		if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+			t.Fatalf("updateQueryLogMetrics failed: %v", err)
+		}
+	}
+
+	if got := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList")) - before; got != 4 {
+		t.Errorf("Expected 4 distinct queries to be counted once each, got %v", got)
+	}
+	want := time.Date(2025, 6, 18, 8, 0, 4, 0, time.UTC)
+	if got := lastSeenQuery[srv.URL]; !got.Equal(want) {
+		t.Errorf("Expected the newest entry %s to be remembered, got %s", want, got)
+	}
+}
+
+func TestQueryLogEntriesWithoutTimeSkipped(t *testing.T) {
+	page := `{"data":[
+		{"question":{"type":"A","name":"timed.example"},"reason":"FilteredBlackList","time":"2025-06-18T08:00:01Z"},
+		{"question":{"type":"A","name":"untimed.example"},"reason":"FilteredBlackList","time":"not a time"},
+		{"question":{"type":"A","name":"untimed.example"},"reason":"FilteredBlackList"}
+	]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(page))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	before := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList"))
+	for i := 0; i < 2; i++ {
+		if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+			t.Fatalf("updateQueryLogMetrics failed: %v", err)
+		}
+	}
+	if got := testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList")) - before; got != 1 {
+		t.Errorf("Expected only the timed entry to be counted across both scrapes, got %v", got)
+	}
+}
+
+func TestLabelCap(t *testing.T) {
+	c := newLabelCap(2)
+	for _, v := range []string{"a", "b", "a"} {
+		if got := c.value(v); got != v {
+			t.Errorf("Expected %q, got %q", v, got)
+		}
+	}
+	if got := c.value("c"); got != "other" {
+		t.Errorf("Expected overflow value to fold into other, got %q", got)
+	}
+}
+
+func syntheticQueryLog(n int) []QueryLogEntry {
+	reasons := []string{"NotFilteredNotFound", "FilteredBlackList", "Rewrite", "NotFilteredWhiteList"}
+	types := []string{"A", "AAAA", "HTTPS", "PTR"}
+	entries := make([]QueryLogEntry, n)
+	for i := range entries {
+		e := &entries[i]
+		e.Question.Type = types[i%len(types)]
+		e.Question.Name = fmt.Sprintf("host%d.example.com", i%200)
+		e.Reason = reasons[i%len(reasons)]
+		e.Client = fmt.Sprintf("192.168.1.%d", i%50)
+		e.Upstream = fmt.Sprintf("tls://10.0.0.%d:853", i%3)
+		e.Elapsed = strconv.FormatFloat(float64(i%40)+0.25, 'f', 2, 64)
+	}
+	return entries
+}
+
+func BenchmarkUpdateQueryLogMetrics(b *testing.B) {
+	entries := syntheticQueryLog(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processQueryLog("test", entries)
+	}
+}
+
+func TestBlockedServices(t *testing.T) {
+	entries := []QueryLogEntry{
+		{Reason: "FilteredBlockedService", ServiceName: "youtube"},
+		{Reason: "FilteredBlockedService", ServiceName: "youtube"},
+		{Reason: "FilteredBlockedService", ServiceName: "facebook"},
+		{Reason: "FilteredBlockedService"}, // older AdGuard without service_name
+		{Reason: "FilteredBlackList"},
+	}
+	expected := map[string]float64{"youtube": 2, "facebook": 1, "unknown": 1}
+	before := map[string]float64{}
+	for service := range expected {
+		before[service] = testutil.ToFloat64(blockedServices.WithLabelValues("test", service))
+	}
+
+	processQueryLog("test", entries)
+
+	for service, want := range expected {
+		if got := testutil.ToFloat64(blockedServices.WithLabelValues("test", service)) - before[service]; got != want {
+			t.Errorf("Expected %v blocked queries for %s, got %v", want, service, got)
+		}
+	}
+}
+
+func TestSanitizeLabelTruncatesLongValues(t *testing.T) {
+	defer func(n int) { maxLabelLength = n }(maxLabelLength)
+	maxLabelLength = 16
+
+	long := strings.Repeat("a", 300) + ".example.com"
+	got := sanitizeLabel(long)
+	if got != "aaaaaaaaaaaaaaaa…" {
+		t.Errorf("Unexpected truncated label %q", got)
+	}
+	if again := sanitizeLabel(long); again != got {
+		t.Errorf("Truncation is not deterministic: %q vs %q", got, again)
+	}
+	if short := sanitizeLabel("example.com"); short != "example.com" {
+		t.Errorf("Expected short label to be untouched, got %q", short)
+	}
+
+	maxLabelLength = 0
+	if got := sanitizeLabel(long); got != long {
+		t.Errorf("Expected no truncation when disabled")
+	}
+}
+
+func TestFetchQueryLogPagination(t *testing.T) {
+	pages := map[string]string{
+		"":                     `{"data":[{"client":"a"},{"client":"b"}],"oldest":"2025-06-18T10:00:00Z"}`,
+		"2025-06-18T10:00:00Z": `{"data":[{"client":"c"}],"oldest":"2025-06-18T09:00:00Z"}`,
+		"2025-06-18T09:00:00Z": `{"data":[{"client":"d"}],"oldest":"2025-06-18T08:00:00Z"}`,
+		"2025-06-18T08:00:00Z": `{"data":[],"oldest":""}`,
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(pages[r.URL.Query().Get("older_than")]))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("QUERYLOG_MAX_PAGES", "10")
+
+	logData, err := NewClient(target{Host: srv.URL}).QueryLog(context.Background())
+	if err != nil {
+		t.Fatalf("QueryLog failed: %v", err)
+	}
+	if len(logData.Data) != 4 {
+		t.Errorf("Expected 4 entries across pages, got %d", len(logData.Data))
+	}
+	if got := testutil.ToFloat64(queryLogPagesFetched.WithLabelValues(srv.URL)); got != float64(requests) || requests != 4 {
+		t.Errorf("Expected 4 pages fetched, got gauge=%v requests=%d", got, requests)
+	}
+
+	requests = 0
+	t.Setenv("QUERYLOG_MAX_PAGES", "2")
+	if _, err := NewClient(target{Host: srv.URL}).QueryLog(context.Background()); err != nil {
+		t.Fatalf("QueryLog failed: %v", err)
+	}
+	if got := testutil.ToFloat64(queryLogPagesFetched.WithLabelValues(srv.URL)); got != 2 || requests != 2 {
+		t.Errorf("Expected pagination to stop at 2 pages, got gauge=%v requests=%d", got, requests)
+	}
+}
+
+func TestBlockedAllSumsComponents(t *testing.T) {
+	var stats AdGuardStats
+	payload := `{"num_dns_queries":1000,"num_blocked_filtering":120,"num_replaced_safebrowsing":7,
+		"num_replaced_safesearch":15,"num_replaced_parental":3}`
+	if err := json.Unmarshal([]byte(payload), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+
+	updateStatsMetrics("test", &stats)
+
+	if got := testutil.ToFloat64(blockedAll.WithLabelValues("test")); got != 145 {
+		t.Errorf("Expected adguard_blocked_all_total 145, got %v", got)
+	}
+	if got := testutil.ToFloat64(blockedFiltering.WithLabelValues("test")); got != 120 {
+		t.Errorf("Expected adguard_blocked_filtering_total 120, got %v", got)
+	}
+	if got := testutil.ToFloat64(replacedParental.WithLabelValues("test")); got != 3 {
+		t.Errorf("Expected adguard_replaced_parental 3, got %v", got)
+	}
+	if got := testutil.ToFloat64(replacedSafebrowsing.WithLabelValues("test")); got != 7 {
+		t.Errorf("Expected adguard_replaced_safebrowsing 7, got %v", got)
+	}
+	if got := testutil.ToFloat64(replacedSafesearch.WithLabelValues("test")); got != 15 {
+		t.Errorf("Expected adguard_replaced_safesearch 15, got %v", got)
+	}
+}
+
+func TestBlockRatio(t *testing.T) {
+	for _, tc := range []struct{ blocked, total, want float64 }{
+		{120, 1000, 0.12},
+		{0, 1000, 0},
+		{5, 5, 1},
+		{0, 0, 0},
+	} {
+		if got := ratio(tc.blocked, tc.total); got != tc.want {
+			t.Errorf("ratio(%v, %v): expected %v, got %v", tc.blocked, tc.total, tc.want, got)
+		}
+	}
+
+	updateStatsMetrics("test", &AdGuardStats{NumDNSQueries: 1000, NumBlockedFiltering: 120})
+	if got := testutil.ToFloat64(blockRatio.WithLabelValues("test")); got != 0.12 {
+		t.Errorf("Expected adguard_block_ratio 0.12, got %v", got)
+	}
+	updateStatsMetrics("test", &AdGuardStats{})
+	if got := testutil.ToFloat64(blockRatio.WithLabelValues("test")); got != 0 {
+		t.Errorf("Expected adguard_block_ratio 0 without queries, got %v", got)
+	}
+}
+
+func TestUpstreamResponseTimeInSeconds(t *testing.T) {
+	var stats AdGuardStats
+	payload := `{"avg_processing_time":0.0042,"top_upstreams_avg_time":[{"tls://1.1.1.1:853":0.0125},{"8.8.8.8:53":0.3}]}`
+	if err := json.Unmarshal([]byte(payload), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+
+	updateStatsMetrics("test", &stats)
+
+	for up, want := range map[string]float64{"tls://1.1.1.1:853": 0.0125, "8.8.8.8:53": 0.3} {
+		if got := testutil.ToFloat64(topUpstreamTime.WithLabelValues("test", up)); got != want {
+			t.Errorf("Expected %s to average %vs, got %v", up, want, got)
+		}
+	}
+	if got := testutil.ToFloat64(avgProcessingTime.WithLabelValues("test")); got != 0.0042 {
+		t.Errorf("Expected avg processing time 0.0042s, got %v", got)
+	}
+}
+
+func TestTopNLimit(t *testing.T) {
+	defer func(n int) { topNLimit = n }(topNLimit)
+	topNLimit = 10
+
+	stats := &AdGuardStats{}
+	for i := 0; i < 100; i++ {
+		stats.TopQueriedDomains = append(stats.TopQueriedDomains, map[string]float64{fmt.Sprintf("d%d.example.com", i): float64(i)})
+	}
+	topQueriedDomains.Reset()
+	updateStatsMetrics("test", stats)
+
+	if n := testutil.CollectAndCount(topQueriedDomains); n != 10 {
+		t.Errorf("Expected 10 top domain series, got %d", n)
+	}
+	if got := testutil.ToFloat64(topQueriedDomains.WithLabelValues("test", "d90.example.com")); got != 90 {
+		t.Errorf("Expected the highest values to be kept, got %v for d90.example.com", got)
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	h := requireBasicAuth("prom", "s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+
+	cases := []struct {
+		name       string
+		user, pass string
+		setAuth    bool
+		want       int
+	}{
+		{"valid", "prom", "s3cret", true, http.StatusOK},
+		{"wrong password", "prom", "nope", true, http.StatusUnauthorized},
+		{"wrong user", "admin", "s3cret", true, http.StatusUnauthorized},
+		{"no credentials", "", "", false, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if c.setAuth {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, rec.Code)
+		}
+		if c.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate challenge", c.name)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	requireBasicAuth("", "", http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected no auth check without EXPORTER_AUTH_USER, got %d", rec.Code)
+	}
+}
+
+func TestExporterBuildInfo(t *testing.T) {
+	expected := fmt.Sprintf(`
+# HELP adguard_exporter_build_info Build of the running exporter, always 1
+# TYPE adguard_exporter_build_info gauge
+adguard_exporter_build_info{commit="dev",goversion=%q,version="dev"} 1
+`, runtime.Version())
+	if err := testutil.CollectAndCompare(exporterBuildInfo, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected build info: %v", err)
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	srv := newServer(":0", nil)
+	if srv.ReadTimeout != 10*time.Second || srv.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("Unexpected default read timeouts: %v / %v", srv.ReadTimeout, srv.ReadHeaderTimeout)
+	}
+	if srv.WriteTimeout != 30*time.Second || srv.IdleTimeout != 60*time.Second {
+		t.Errorf("Unexpected default write/idle timeouts: %v / %v", srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	t.Setenv("HTTP_READ_TIMEOUT", "5")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "12")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "90")
+	srv = newServer(":0", nil)
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 12*time.Second || srv.IdleTimeout != 90*time.Second {
+		t.Errorf("Timeouts not taken from env: read=%v write=%v idle=%v", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+func TestServeShutsDownOnCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, ln, false) }()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the server to be up, got %v", err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatalf("Server did not shut down within %s", shutdownTimeout)
+	}
+	if conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Expected the listener to be closed after shutdown")
+	}
+}
+
+func TestRunScrapeLoopFinishesScrapeOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var scrapes, finished atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runScrapeLoop(ctx, time.Hour, func(context.Context) {
+			scrapes.Add(1)
+			cancel()
+			time.Sleep(20 * time.Millisecond)
+			finished.Add(1)
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Scrape loop did not stop after cancel")
+	}
+	if scrapes.Load() != 1 || finished.Load() != 1 {
+		t.Errorf("Expected the in-flight scrape to finish, got %d started / %d finished", scrapes.Load(), finished.Load())
+	}
+}
+
+func TestRunScrapeLoopSkipsTicksWhileScraping(t *testing.T) {
+	before := testutil.ToFloat64(scrapeOverruns)
+	ctx, cancel := context.WithCancel(context.Background())
+	var scrapes, running, overlapped atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runScrapeLoop(ctx, 10*time.Millisecond, func(context.Context) {
+			if running.Add(1) > 1 {
+				overlapped.Add(1)
+			}
+			if scrapes.Add(1) == 1 {
+				time.Sleep(45 * time.Millisecond)
+			}
+			running.Add(-1)
+		})
+	}()
+	time.Sleep(80 * time.Millisecond)
+	cancel()
+	<-done
+
+	if got := testutil.ToFloat64(scrapeOverruns) - before; got < 1 {
+		t.Errorf("Expected the slow scrape to cause overruns, got %v", got)
+	}
+	if overlapped.Load() != 0 {
+		t.Errorf("Expected scrapes never to overlap, got %d overlapping", overlapped.Load())
+	}
+	if scrapes.Load() < 2 {
+		t.Errorf("Expected scraping to resume after the slow scrape, got %d scrapes", scrapes.Load())
+	}
+}
+
+func TestAPIRequestDurationObservedPerEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	endpoints := []string{"stats", "status", "querylog"}
+	before := map[string]uint64{}
+	for _, e := range endpoints {
+		before[e] = histogramCount(t, apiRequestDuration.WithLabelValues(srv.URL, e))
+	}
+
+	NewClient(target{Host: srv.URL}).Stats(context.Background())
+	NewClient(target{Host: srv.URL}).Status(context.Background())
+	NewClient(target{Host: srv.URL}).QueryLog(context.Background())
+
+	for _, e := range endpoints {
+		if got := histogramCount(t, apiRequestDuration.WithLabelValues(srv.URL, e)) - before[e]; got != 1 {
+			t.Errorf("Expected 1 observation for %s, got %d", e, got)
+		}
+	}
+}
+
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestParseBuckets(t *testing.T) {
+	def := []float64{1, 2}
+	if got := parseBuckets("0.01, 0.1,1", def); len(got) != 3 || got[0] != 0.01 || got[2] != 1 {
+		t.Errorf("Unexpected buckets %v", got)
+	}
+	for _, raw := range []string{"", "a,b", "1,0.5"} {
+		if got := parseBuckets(raw, def); len(got) != 2 {
+			t.Errorf("Expected default buckets for %q, got %v", raw, got)
+		}
+	}
+}
+
+func TestQueryLatencyBuckets(t *testing.T) {
+	bounds := func() []float64 {
+		var m dto.Metric
+		if err := queryHistogramByType.WithLabelValues("buckets", "A").(prometheus.Metric).Write(&m); err != nil {
+			t.Fatalf("Failed to read histogram: %v", err)
+		}
+		var got []float64
+		for _, b := range m.GetHistogram().GetBucket() {
+			got = append(got, b.GetUpperBound())
+		}
+		return got
+	}
+
+	if os.Getenv("QUERY_LATENCY_BUCKETS") == "" {
+		if got, want := bounds(), prometheus.LinearBuckets(1, 5, 10); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the linear default buckets %v, got %v", want, got)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestQueryLatencyBuckets$")
+		cmd.Env = append(os.Environ(), "QUERY_LATENCY_BUCKETS=5, 50,250,1000")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Custom bucket run failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	if got, want := bounds(), []float64{5, 50, 250, 1000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected buckets %v, got %v", want, got)
+	}
+}
+
+func TestLoginRetriesUntilAdGuardIsUp(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"running":true}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	if err := login(context.Background(), NewClient(target{Host: srv.URL}), 5, time.Millisecond); err != nil {
+		t.Fatalf("Expected login to succeed, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 login attempts, got %d", attempts)
+	}
+
+	attempts = 0
+	if err := login(context.Background(), NewClient(target{Host: srv.URL}), 1, time.Millisecond); err == nil {
+		t.Errorf("Expected login to fail once retries are exhausted")
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts before giving up, got %d", attempts)
+	}
+}
+
+func TestStatusInventoryGauges(t *testing.T) {
+	var status AdGuardStatus
+	payload := `{"version":"v0.107.52","dns_addresses":["192.168.1.2","fe80::1"],"dns_port":53,"http_port":3000,"running":true}`
+	if err := json.Unmarshal([]byte(payload), &status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+
+	updateStatusMetrics("test", &status)
+
+	for name, tc := range map[string]struct {
+		got, want float64
+	}{
+		"adguard_dns_port":            {testutil.ToFloat64(statusDNSPort.WithLabelValues("test")), 53},
+		"adguard_http_port":           {testutil.ToFloat64(statusHTTPPort.WithLabelValues("test")), 3000},
+		"adguard_dns_addresses_count": {testutil.ToFloat64(statusDNSAddresses.WithLabelValues("test")), 2},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Expected %s %v, got %v", name, tc.want, tc.got)
+		}
+	}
+}
+
+func TestSafeSearchPerService(t *testing.T) {
+	safeSearchEnabled.Reset()
+	payload := `{"enabled":true,"bing":true,"duckduckgo":false,"google":true,"youtube":false}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	services, err := NewClient(target{Host: srv.URL}).SafeSearch(context.Background())
+	if err != nil {
+		t.Fatalf("SafeSearch failed: %v", err)
+	}
+	updateSafeSearchMetrics("test", services)
+
+	expected := map[string]float64{"bing": 1, "duckduckgo": 0, "google": 1, "youtube": 0}
+	for service, want := range expected {
+		if got := testutil.ToFloat64(safeSearchEnabled.WithLabelValues("test", service)); got != want {
+			t.Errorf("Expected %s=%v, got %v", service, want, got)
+		}
+	}
+	if n := testutil.CollectAndCount(safeSearchEnabled); n != len(expected) {
+		t.Errorf("Expected %d series, got %d", len(expected), n)
+	}
+
+	// Older AdGuard versions only report a single flag.
+	payload = `{"enabled":true}`
+	services, err = NewClient(target{Host: srv.URL}).SafeSearch(context.Background())
+	if err != nil {
+		t.Fatalf("SafeSearch failed: %v", err)
+	}
+	if len(services) != 1 || !services["global"] {
+		t.Errorf("Expected a single enabled global service, got %v", services)
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(l int32, j bool) { currentLogLevel.Store(l); logJSON.Store(j) }(currentLogLevel.Load(), logJSON.Load())
+	currentLogLevel.Store(logLevelMap["DEBUG"])
+	logJSON.Store(true)
+
+	for level := range logLevelMap {
+		buf.Reset()
+		logKV(level, "Failed to fetch stats", "instance", "http://adguard:3000", "error", fmt.Errorf("boom"))
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: expected a JSON line, got %q: %v", level, buf.String(), err)
+		}
+		if entry["level"] != level || entry["msg"] != "Failed to fetch stats" {
+			t.Errorf("%s: unexpected level/msg in %v", level, entry)
+		}
+		if entry["instance"] != "http://adguard:3000" || entry["error"] != "boom" {
+			t.Errorf("%s: expected structured fields, got %v", level, entry)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(entry["ts"])); err != nil {
+			t.Errorf("%s: expected an RFC3339 ts, got %v", level, entry["ts"])
+		}
+	}
+
+	buf.Reset()
+	currentLogLevel.Store(logLevelMap["WARN"])
+	logX("DEBUG", "hidden")
+	if buf.Len() != 0 {
+		t.Errorf("Expected DEBUG to be filtered at WARN, got %q", buf.String())
+	}
+
+	logJSON.Store(false)
+	logKV("WARN", "Failed to fetch stats", "instance", "a")
+	if !strings.Contains(buf.String(), "[WARN] Failed to fetch stats instance=a") {
+		t.Errorf("Expected key=value pairs in text mode, got %q", buf.String())
+	}
+}
+
+// TestLogLevelConcurrentAccess is meant for go test -race: log calls from
+// scrape goroutines run while the level is reloaded.
+func TestLogLevelConcurrentAccess(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(l int32, j bool) { currentLogLevel.Store(l); logJSON.Store(j) }(currentLogLevel.Load(), logJSON.Load())
+	t.Setenv("LOG_LEVEL", "DEBUG")
+	t.Setenv("LOG_FORMAT", "json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				logKV("DEBUG", "Fetched stats", "instance", "http://adguard:3000")
+			}
+		}()
+	}
+	for j := 0; j < 50; j++ {
+		initLogger()
+		currentLogLevel.Store(logLevelMap["WARN"])
+	}
+	wg.Wait()
+
+	if got := currentLogLevel.Load(); got != logLevelMap["WARN"] {
+		t.Errorf("Expected the last stored level WARN, got %d", got)
+	}
+}
+
+func TestScrapeIDConsistentWithinCycle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/control/status" {
+			w.Write([]byte(`not json`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	reloadClients()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(l int32) { currentLogLevel.Store(l) }(currentLogLevel.Load())
+	currentLogLevel.Store(logLevelMap["DEBUG"])
+
+	ids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		updateMetrics(context.Background())
+
+		cycle := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			_, rest, ok := strings.Cut(line, "[scrape=")
+			if !ok {
+				t.Errorf("Log line without scrape ID: %q", line)
+				continue
+			}
+			id, _, _ := strings.Cut(rest, "]")
+			cycle[id] = true
+		}
+		if len(cycle) != 1 {
+			t.Errorf("Expected a single scrape ID per cycle, got %v", cycle)
+		}
+		for id := range cycle {
+			ids[id] = true
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("Expected a new scrape ID per cycle, got %v", ids)
+	}
+	if id := currentScrapeID(); id != "" {
+		t.Errorf("Expected scrape ID to be cleared after the cycle, got %q", id)
+	}
+}
+
+func TestFilterListCounts(t *testing.T) {
+	var filtering AdGuardFiltering
+	payload := `{"enabled":true,
+		"filters":[
+			{"id":1,"name":"AdGuard DNS filter","enabled":true,"rules_count":50000},
+			{"id":2,"name":"AdAway","enabled":false,"rules_count":6000},
+			{"id":3,"name":"OISD","enabled":true,"rules_count":200000}
+		],
+		"whitelist_filters":[{"id":4,"name":"Allow","enabled":false}]}`
+	if err := json.Unmarshal([]byte(payload), &filtering); err != nil {
+		t.Fatalf("Failed to decode filtering status: %v", err)
+	}
+
+	updateFilteringMetrics("test", &filtering)
+
+	expected := map[string][2]float64{"blocklist": {3, 2}, "allowlist": {1, 0}}
+	for list, want := range expected {
+		if got := testutil.ToFloat64(filtersTotal.WithLabelValues("test", list)); got != want[0] {
+			t.Errorf("Expected %v %s filters, got %v", want[0], list, got)
+		}
+		if got := testutil.ToFloat64(filtersEnabled.WithLabelValues("test", list)); got != want[1] {
+			t.Errorf("Expected %v enabled %s filters, got %v", want[1], list, got)
+		}
+	}
+}
+
+func TestPerFilterMetrics(t *testing.T) {
+	payload := `{"enabled":true,
+		"filters":[
+			{"id":1,"name":"AdGuard DNS filter","url":"https://adguardteam.github.io/filter.txt","enabled":true,
+			 "rules_count":50000,"last_updated":"2025-06-18T12:00:00Z"},
+			{"id":2,"name":"AdAway","url":"https://adaway.org/hosts.txt","enabled":false,
+			 "rules_count":6000,"last_updated":"2025-06-18T13:30:00+07:00"},
+			{"id":3,"name":"New list","url":"https://example.com/new.txt","enabled":true,"rules_count":0}
+		]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	filtering, err := NewClient(target{Host: srv.URL}).Filtering(context.Background())
+	if err != nil {
+		t.Fatalf("Filtering failed: %v", err)
+	}
+	updateFilteringMetrics(srv.URL, filtering)
+
+	if got := testutil.ToFloat64(filterRulesCount.WithLabelValues(srv.URL, "blocklist", "AdGuard DNS filter", "https://adguardteam.github.io/filter.txt")); got != 50000 {
+		t.Errorf("Expected 50000 rules, got %v", got)
+	}
+	if got := testutil.ToFloat64(filterEnabled.WithLabelValues(srv.URL, "blocklist", "AdAway")); got != 0 {
+		t.Errorf("Expected AdAway to be disabled, got %v", got)
+	}
+	expected := map[string]float64{"AdGuard DNS filter": 1750248000, "AdAway": 1750228200}
+	for name, want := range expected {
+		if got := testutil.ToFloat64(filterLastUpdated.WithLabelValues(srv.URL, "blocklist", name)); got != want {
+			t.Errorf("Expected %s last updated at %v, got %v", name, want, got)
+		}
+	}
+	if filterLastUpdated.DeleteLabelValues(srv.URL, "blocklist", "New list") {
+		t.Errorf("Expected no timestamp for a list that was never updated")
+	}
+}
+
+func TestReplicaQueryLag(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"num_dns_queries":1500}`))
+	}))
+	defer primary.Close()
+	var replicaUser string
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replicaUser, _, _ = r.BasicAuth()
+		w.Write([]byte(`{"num_dns_queries":1420}`))
+	}))
+	defer replica.Close()
+
+	t.Setenv("ADGUARD_HOST", primary.URL)
+	t.Setenv("ADGUARD_REPLICA_HOST", replica.URL)
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("REPLICA_USER", "replica-admin")
+
+	set := reloadClients()
+	stats, err := set.instances[0].Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	updateReplicaMetrics(context.Background(), set.replica, primary.URL, stats)
+
+	if got := testutil.ToFloat64(replicaQueryLag.WithLabelValues(primary.URL)); got != 80 {
+		t.Errorf("Expected replica lag 80, got %v", got)
+	}
+	if replicaUser != "replica-admin" {
+		t.Errorf("Expected replica credentials, got user %q", replicaUser)
+	}
+}
+
+func TestNoAuthorizationHeaderWithoutCredentials(t *testing.T) {
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_USER", "")
+	t.Setenv("ADGUARD_PASS", "")
+
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if header != "" {
+		t.Errorf("Expected no Authorization header with empty credentials, got %q", header)
+	}
+
+	t.Setenv("ADGUARD_USER", "admin")
+	t.Setenv("ADGUARD_PASS", "secret")
+	t.Setenv("ADGUARD_AUTH_MODE", "none")
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if header != "" {
+		t.Errorf("Expected no Authorization header with ADGUARD_AUTH_MODE=none, got %q", header)
+	}
+}
+
+func TestQueryRcodeCounts(t *testing.T) {
+	entries := []QueryLogEntry{
+		{Status: "NOERROR"}, {Status: "NOERROR"}, {Status: "NXDOMAIN"},
+		{Status: "SERVFAIL"}, {Status: "refused"}, {Status: "BOGUS"}, {},
+	}
+	expected := map[string]float64{"NOERROR": 2, "NXDOMAIN": 1, "SERVFAIL": 1, "REFUSED": 1, "other": 1, "unknown": 1}
+	before := map[string]float64{}
+	for rcode := range expected {
+		before[rcode] = testutil.ToFloat64(queryCountByRcode.WithLabelValues("test", rcode))
+	}
+
+	processQueryLog("test", entries)
+
+	for rcode, want := range expected {
+		if got := testutil.ToFloat64(queryCountByRcode.WithLabelValues("test", rcode)) - before[rcode]; got != want {
+			t.Errorf("Expected %v queries with rcode %s, got %v", want, rcode, got)
+		}
+	}
+}
+
+func TestClientUpstreamCount(t *testing.T) {
+	entries := []QueryLogEntry{
+		{Client: "10.0.0.7", Upstream: "https://dns.google/dns-query"},
+		{Client: "10.0.0.7", Upstream: "tls://1.1.1.1"},
+		{Client: "10.0.0.7", Upstream: "tls://1.1.1.1"},
+		{Client: "10.0.0.7", Upstream: "8.8.8.8:53"},
+		{Client: "10.0.0.7", Reason: "FilteredBlackList"}, // blocked, no upstream
+		{Client: "10.0.0.8", Upstream: "tls://1.1.1.1"},
+	}
+
+	processQueryLog("test", entries)
+
+	if got := testutil.ToFloat64(clientUpstreamCount.WithLabelValues("test", "10.0.0.7")); got != 3 {
+		t.Errorf("Expected 3 distinct upstreams for 10.0.0.7, got %v", got)
+	}
+	if got := testutil.ToFloat64(clientUpstreamCount.WithLabelValues("test", "10.0.0.8")); got != 1 {
+		t.Errorf("Expected 1 upstream for 10.0.0.8, got %v", got)
+	}
+}
+
+func TestBlockedCustomAnswerInfo(t *testing.T) {
+	blockedCustomAnswer.Reset()
+	defer func(b bool) { blockedAnswerInfo = b }(blockedAnswerInfo)
+	blockedAnswerInfo = true
+
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"reason":"FilteredBlackList","answer":[{"type":"A","value":"192.168.1.254","ttl":10}]},
+		{"reason":"FilteredBlackList","answer":[{"type":"A","value":"192.168.1.254","ttl":10}]},
+		{"reason":"FilteredBlockedService","answer":[{"type":"AAAA","value":"::","ttl":10}]},
+		{"reason":"NotFilteredNotFound","answer":[{"type":"A","value":"93.184.216.34","ttl":300}]},
+		{"reason":"FilteredBlackList","answer":["unexpected"]}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+
+	processQueryLog("test", logData.Data)
+
+	if got := testutil.ToFloat64(blockedCustomAnswer.WithLabelValues("test", "A", "192.168.1.254")); got != 1 {
+		t.Errorf("Expected custom blocking IP to be reported, got %v", got)
+	}
+	if got := testutil.ToFloat64(blockedCustomAnswer.WithLabelValues("test", "AAAA", "::")); got != 1 {
+		t.Errorf("Expected AAAA blocking answer to be reported, got %v", got)
+	}
+	if n := testutil.CollectAndCount(blockedCustomAnswer); n != 2 {
+		t.Errorf("Expected only answers of blocked queries, got %d series", n)
+	}
+}
+
+func TestReasonAllowlistFoldsUnknownReasons(t *testing.T) {
+	defer func(m map[string]bool) { reasonAllowlist = m }(reasonAllowlist)
+
+	if got := reasonLabel("FilteredSafeBrowsing"); got != "FilteredSafeBrowsing" {
+		t.Errorf("Expected known reason to be kept by default, got %q", got)
+	}
+	if got := reasonLabel("FilteredSomethingNew"); got != "other" {
+		t.Errorf("Expected unknown reason to fold into other by default, got %q", got)
+	}
+
+	reasonAllowlist = newReasonAllowlist([]string{"FilteredBlackList", " NotFilteredNotFound "})
+	before := testutil.ToFloat64(queryCountByReason.WithLabelValues("test", "other"))
+	processQueryLog("test", []QueryLogEntry{
+		{Reason: "FilteredBlackList"}, {Reason: "NotFilteredNotFound"}, {Reason: "Rewrite"}, {Reason: "ForkReason"},
+	})
+	if got := testutil.ToFloat64(queryCountByReason.WithLabelValues("test", "other")) - before; got != 2 {
+		t.Errorf("Expected 2 reasons folded into other, got %v", got)
+	}
+}
+
+func TestUpdateCycleDurationIsSet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	reloadClients()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func(d time.Duration) { scrapeInterval = d }(scrapeInterval)
+	scrapeInterval = time.Millisecond
+
+	updateCycleDuration.Set(0)
+	updateMetrics(context.Background())
+
+	if got := testutil.ToFloat64(updateCycleDuration); got < 0.005 {
+		t.Errorf("Expected cycle duration of at least 5ms, got %vs", got)
+	}
+	if !strings.Contains(buf.String(), "longer than SCRAPE_INTERVAL") {
+		t.Errorf("Expected a WARN when the cycle exceeds the interval, got logs:\n%s", buf.String())
+	}
+}
+
+func TestDHCPLeaseExpiry(t *testing.T) {
+	dhcpLeaseExpiry.Reset()
+	var dhcp AdGuardDHCP
+	payload := `{"enabled":true,
+		"leases":[
+			{"mac":"aa:bb:cc:dd:ee:01","ip":"192.168.1.50","hostname":"phone","expires":"2025-06-18T12:00:00Z"},
+			{"mac":"aa:bb:cc:dd:ee:02","ip":"192.168.1.51","hostname":"laptop","expires":"2025-06-18T13:30:00+07:00"}
+		],
+		"static_leases":[{"mac":"aa:bb:cc:dd:ee:03","ip":"192.168.1.10","hostname":"nas"}]}`
+	if err := json.Unmarshal([]byte(payload), &dhcp); err != nil {
+		t.Fatalf("Failed to decode DHCP status: %v", err)
+	}
+
+	updateDHCPMetrics("test", &dhcp)
+
+	expected := map[[2]string]float64{
+		{"192.168.1.50", "aa:bb:cc:dd:ee:01"}: 1750248000,
+		{"192.168.1.51", "aa:bb:cc:dd:ee:02"}: 1750228200,
+		{"192.168.1.10", "aa:bb:cc:dd:ee:03"}: 0,
+	}
+	for lease, want := range expected {
+		if got := testutil.ToFloat64(dhcpLeaseExpiry.WithLabelValues("test", lease[0], lease[1])); got != want {
+			t.Errorf("Expected expiry %v for %s, got %v", want, lease[0], got)
+		}
+	}
+	if n := testutil.CollectAndCount(dhcpLeaseExpiry); n != 3 {
+		t.Errorf("Expected one series per lease, got %d", n)
+	}
+}
+
+func TestDHCPLeaseCounts(t *testing.T) {
+	payload := `{"enabled":true,"leases":[{"ip":"192.168.1.50"},{"ip":"192.168.1.51"}],"static_leases":[{"ip":"192.168.1.10"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	dhcp, err := NewClient(target{Host: srv.URL}).DHCP(context.Background())
+	if err != nil {
+		t.Fatalf("DHCP failed: %v", err)
+	}
+	updateDHCPMetrics(srv.URL, dhcp)
+	for name, want := range map[string][2]float64{
+		"enabled":       {testutil.ToFloat64(dhcpEnabled.WithLabelValues(srv.URL)), 1},
+		"leases":        {testutil.ToFloat64(dhcpLeases.WithLabelValues(srv.URL)), 2},
+		"static leases": {testutil.ToFloat64(dhcpStaticLeases.WithLabelValues(srv.URL)), 1},
+	} {
+		if want[0] != want[1] {
+			t.Errorf("Expected DHCP %s %v, got %v", name, want[1], want[0])
+		}
+	}
+
+	// AdGuard without a configured DHCP server returns an empty object.
+	payload = `{}`
+	if dhcp, err = NewClient(target{Host: srv.URL}).DHCP(context.Background()); err != nil {
+		t.Fatalf("DHCP failed on an empty object: %v", err)
+	}
+	updateDHCPMetrics(srv.URL, dhcp)
+	if got := testutil.ToFloat64(dhcpEnabled.WithLabelValues(srv.URL)); got != 0 {
+		t.Errorf("Expected DHCP to be reported disabled, got %v", got)
+	}
+	if dhcpLeases.DeleteLabelValues(srv.URL) || dhcpStaticLeases.DeleteLabelValues(srv.URL) {
+		t.Errorf("Expected no lease counts while DHCP is not configured")
+	}
+}
+
+func TestTLDLabel(t *testing.T) {
+	tests := map[string]string{
+		"www.example.com":          "com",
+		"www.bbc.co.uk.":           "co.uk",
+		"Mail.Google.COM":          "com",
+		"foo.github.io":            "github.io",
+		"1.1.168.192.in-addr.arpa": "in-addr.arpa",
+		"router.lan":               "lan",
+		"":                         "invalid",
+		"bad..name.com":            "invalid",
+		".leading.org":             "invalid",
+	}
+	for name, want := range tests {
+		if got := tldLabel(name); got != want {
+			t.Errorf("tldLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestQueryTLDCountsAreGated(t *testing.T) {
+	defer func(b bool) { tldMetrics = b }(tldMetrics)
+	entries := make([]QueryLogEntry, 2)
+	entries[0].Question.Name = "a.example.net"
+	entries[1].Question.Name = "b.example.net"
+
+	tldMetrics = false
+	before := testutil.ToFloat64(queryCountByTLD.WithLabelValues("test", "net"))
+	processQueryLog("test", entries)
+	if got := testutil.ToFloat64(queryCountByTLD.WithLabelValues("test", "net")) - before; got != 0 {
+		t.Errorf("Expected no TLD counts when disabled, got %v", got)
+	}
+
+	tldMetrics = true
+	processQueryLog("test", entries)
+	if got := testutil.ToFloat64(queryCountByTLD.WithLabelValues("test", "net")) - before; got != 2 {
+		t.Errorf("Expected 2 queries for net, got %v", got)
+	}
+}
+
+func TestProtectionDisabledReason(t *testing.T) {
+	protectionDisabledReason.Reset()
+	tests := []struct {
+		payload string
+		reason  string
+	}{
+		{`{"protection_enabled":false,"protection_disabled_reason":"schedule"}`, "schedule"},
+		{`{"protection_enabled":false,"protection_disabled_duration":600000}`, "timed"},
+		{`{"protection_enabled":false}`, "manual"},
+		{`{"protection_enabled":true}`, ""},
+	}
+	for _, tt := range tests {
+		var status AdGuardStatus
+		if err := json.Unmarshal([]byte(tt.payload), &status); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+		updateStatusMetrics("test", &status)
+
+		if tt.reason == "" {
+			if n := testutil.CollectAndCount(protectionDisabledReason); n != 0 {
+				t.Errorf("Expected no reason while protection is enabled, got %d series", n)
+			}
+			continue
+		}
+		if got := testutil.ToFloat64(protectionDisabledReason.WithLabelValues("test", tt.reason)); got != 1 {
+			t.Errorf("%s: expected reason %q, got %v", tt.payload, tt.reason, got)
+		}
+		if n := testutil.CollectAndCount(protectionDisabledReason); n != 1 {
+			t.Errorf("%s: expected a single reason series, got %d", tt.payload, n)
+		}
+	}
+}
+
+func TestProtectionStatus(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		updateStatusMetrics("test", &AdGuardStatus{ProtectionEnabled: enabled, ProtectionDisabledDuration: 1500})
+
+		want := map[string]float64{"enabled": boolToFloat(enabled), "disabled": boolToFloat(!enabled)}
+		for state, v := range want {
+			if got := testutil.ToFloat64(protectionStatus.WithLabelValues("test", state)); got != v {
+				t.Errorf("enabled=%t: expected state=%s to be %v, got %v", enabled, state, v, got)
+			}
+		}
+		if got := testutil.ToFloat64(statusProtectionEnabled.WithLabelValues("test")); got != boolToFloat(enabled) {
+			t.Errorf("enabled=%t: expected adguard_protection_enabled %v, got %v", enabled, boolToFloat(enabled), got)
+		}
+		if got := testutil.ToFloat64(statusDisabledDuration.WithLabelValues("test")); got != 1500 {
+			t.Errorf("Expected the disabled duration to be kept, got %v", got)
+		}
+	}
+}
+
+func TestProtectionLastChange(t *testing.T) {
+	instance := "protection-change"
+	base := time.Date(2025, 6, 18, 12, 0, 0, 0, time.UTC)
+
+	recordProtectionChange(instance, true, 0, base)
+	if protectionLastChange.DeleteLabelValues(instance) {
+		t.Fatalf("Expected no timestamp before a change is observed")
+	}
+
+	recordProtectionChange(instance, false, 0, base.Add(time.Minute))
+	if got := testutil.ToFloat64(protectionLastChange.WithLabelValues(instance)); got != float64(base.Add(time.Minute).Unix()) {
+		t.Errorf("Expected the disable to be timestamped, got %v", got)
+	}
+	recordProtectionChange(instance, false, 0, base.Add(2*time.Minute))
+	if got := testutil.ToFloat64(protectionLastChange.WithLabelValues(instance)); got != float64(base.Add(time.Minute).Unix()) {
+		t.Errorf("Expected the timestamp to hold while protection stays off, got %v", got)
+	}
+	recordProtectionChange(instance, true, 0, base.Add(10*time.Minute))
+	if got := testutil.ToFloat64(protectionLastChange.WithLabelValues(instance)); got != float64(base.Add(10*time.Minute).Unix()) {
+		t.Errorf("Expected the re-enable to be timestamped, got %v", got)
+	}
+
+	restarted := "protection-change-restarted"
+	recordProtectionChange(restarted, false, 90*time.Second, base)
+	if got := testutil.ToFloat64(protectionLastChange.WithLabelValues(restarted)); got != float64(base.Add(-90*time.Second).Unix()) {
+		t.Errorf("Expected the first scrape while disabled to seed now minus the disabled duration, got %v", got)
+	}
+	recordProtectionChange(restarted, false, 30*time.Second, base.Add(time.Minute))
+	if got := testutil.ToFloat64(protectionLastChange.WithLabelValues(restarted)); got != float64(base.Add(-90*time.Second).Unix()) {
+		t.Errorf("Expected the seeded timestamp to hold while protection stays off, got %v", got)
+	}
+}
+
+func TestCheckScrapeIntervalWarnsWhenTooSmall(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	before := testutil.ToFloat64(configWarnings)
+	if !checkScrapeInterval(time.Second) {
+		t.Errorf("Expected a warning for a 1s interval")
+	}
+	if !strings.Contains(buf.String(), "[WARN]") || !strings.Contains(buf.String(), "SCRAPE_INTERVAL") {
+		t.Errorf("Expected a SCRAPE_INTERVAL WARN log line, got %q", buf.String())
+	}
+	if got := testutil.ToFloat64(configWarnings) - before; got != 1 {
+		t.Errorf("Expected config warnings to grow by 1, got %v", got)
+	}
+
+	buf.Reset()
+	if checkScrapeInterval(15 * time.Second) {
+		t.Errorf("Expected no warning for a 15s interval")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no log output for a 15s interval, got %q", buf.String())
+	}
+}
+
+func TestInstrumentHandlerCountsRequests(t *testing.T) {
+	h := instrumentHandler("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("/test", "418"))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	}
+	if got := testutil.ToFloat64(httpRequests.WithLabelValues("/test", "418")) - before; got != 2 {
+		t.Errorf("Expected request counter to grow by 2, got %v", got)
+	}
+	if testutil.CollectAndCount(httpRequestDuration, "adguard_exporter_http_request_duration_seconds") == 0 {
+		t.Errorf("Expected request durations to be observed")
+	}
+}
+
+func TestAlignedQueryLogWindowsTileWithoutOverlap(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	// One entry per second from 11:59:30 to 12:00:44, newest first.
+	var entries []QueryLogEntry
+	for i := 74; i >= 0; i-- {
+		var q QueryLogEntry
+		q.Time = base.Add(time.Duration(i-30) * time.Second).Format(time.RFC3339Nano)
+		entries = append(entries, q)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		olderThan, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("older_than"))
+		var page AdGuardQueryLog
+		for _, q := range entries {
+			ts, _ := time.Parse(time.RFC3339Nano, q.Time)
+			if ts.Before(olderThan) && len(page.Data) < 4 {
+				page.Data = append(page.Data, q)
+				page.Oldest = q.Time
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("QUERYLOG_MAX_PAGES", "20")
+
+	defer func(d time.Duration) { scrapeInterval = d }(scrapeInterval)
+	scrapeInterval = 15 * time.Second
+
+	seen := map[string]int{}
+	for _, now := range []time.Time{base.Add(20 * time.Second), base.Add(37 * time.Second)} {
+		start, end := alignedWindow(srv.URL, now)
+		logData, _, err := NewClient(target{Host: srv.URL}).QueryLogWindow(context.Background(), start, end)
+		if err != nil {
+			t.Fatalf("QueryLogWindow failed: %v", err)
+		}
+		lastWindowEnd[srv.URL] = end
+		for _, q := range logData.Data {
+			seen[q.Time]++
+		}
+	}
+
+	// Windows [12:00:00, 12:00:15) and [12:00:15, 12:00:30).
+	if len(seen) != 30 {
+		t.Errorf("Expected 30 distinct entries across both windows, got %d", len(seen))
+	}
+	for ts, n := range seen {
+		if n != 1 {
+			t.Errorf("Entry %s counted %d times", ts, n)
+		}
+		parsed, _ := time.Parse(time.RFC3339Nano, ts)
+		if parsed.Before(base) || !parsed.Before(base.Add(30*time.Second)) {
+			t.Errorf("Entry %s outside the aligned windows", ts)
+		}
+	}
+}
+
+func TestQueryLogWindowResumesAfterPageLimit(t *testing.T) {
+	defer func(d time.Duration, a bool) { scrapeInterval, queryLogAlign = d, a }(scrapeInterval, queryLogAlign)
+	scrapeInterval, queryLogAlign = time.Hour, true
+
+	end := time.Now().Truncate(scrapeInterval)
+	var entries []QueryLogEntry
+	for i := 1; i <= 12; i++ {
+		var q QueryLogEntry
+		q.Reason = "FilteredBlackList"
+		q.Time = end.Add(time.Duration(-5*i) * time.Minute).Format(time.RFC3339Nano)
+		entries = append(entries, q)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		olderThan, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("older_than"))
+		var page AdGuardQueryLog
+		for _, q := range entries {
+			ts, _ := time.Parse(time.RFC3339Nano, q.Time)
+			if ts.Before(olderThan) && len(page.Data) < 4 {
+				page.Data = append(page.Data, q)
+				page.Oldest = q.Time
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("QUERYLOG_MAX_PAGES", "2")
+	lastWindowEnd[srv.URL] = end.Add(-scrapeInterval)
+
+	counted := func() float64 {
+		return testutil.ToFloat64(queryCountByReason.WithLabelValues(srv.URL, "FilteredBlackList"))
+	}
+	before := counted()
+	if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+		t.Fatalf("updateQueryLogMetrics failed: %v", err)
+	}
+	if got := counted() - before; got != 8 {
+		t.Errorf("Expected the 8 entries of two pages to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(queryLogTruncated.WithLabelValues(srv.URL)); got != 1 {
+		t.Errorf("Expected the truncated window to be counted, got %v", got)
+	}
+	if got := lastWindowEnd[srv.URL]; !got.Equal(end.Add(-scrapeInterval)) {
+		t.Errorf("Expected lastWindowEnd to stay at the window start, got %s", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := updateQueryLogMetrics(context.Background(), NewClient(target{Host: srv.URL})); err != nil {
+			t.Fatalf("updateQueryLogMetrics failed: %v", err)
+		}
+	}
+	if got := counted() - before; got != 12 {
+		t.Errorf("Expected all 12 entries to be counted once, got %v", got)
+	}
+	if got := lastWindowEnd[srv.URL]; !got.Equal(end) {
+		t.Errorf("Expected the window to be complete up to %s, got %s", end, got)
+	}
+	if _, ok := queryLogResumes[srv.URL]; ok {
+		t.Errorf("Expected no unfinished window left")
+	}
+}
+
+func TestDecodeDurationObserved(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"num_dns_queries": 1}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	before := histogramCount(t, decodeDuration.WithLabelValues(srv.URL, "stats"))
+	var stats AdGuardStats
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err != nil {
+		t.Fatalf("fetchJSON failed: %v", err)
+	}
+	if got := histogramCount(t, decodeDuration.WithLabelValues(srv.URL, "stats")) - before; got != 1 {
+		t.Errorf("Expected one decode observation, got %d", got)
+	}
+}
+
+func TestNormalizeUpstream(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"https://dns.google:443/dns-query", "dns.google"},
+		{"https://dns.google/dns-query", "dns.google"},
+		{"tls://dns.google", "dns.google"},
+		{"quic://DNS.Google:853", "dns.google"},
+		{"dns.google:53", "dns.google"},
+		{"dns.google", "dns.google"},
+		{"tls://1.1.1.1:853", "1.1.1.1"},
+		{"1.1.1.1:53", "1.1.1.1"},
+		{"1.1.1.1", "1.1.1.1"},
+		{"[2606:4700:4700::1111]:53", "2606:4700:4700::1111"},
+		{"2606:4700:4700::1111", "2606:4700:4700::1111"},
+	}
+	for _, tt := range tests {
+		if got := normalizeUpstream(tt.input); got != tt.expected {
+			t.Errorf("normalizeUpstream(%q): expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestUpstreamNormalizeCollapsesTopUpstreams(t *testing.T) {
+	defer func(b bool) { upstreamNormalize = b }(upstreamNormalize)
+	upstreamNormalize = true
+
+	updateStatsMetrics("test", &AdGuardStats{TopUpstream: []map[string]float64{
+		{"https://dns.google:443/dns-query": 3},
+		{"tls://dns.google:853": 2},
+	}})
+	if got := testutil.ToFloat64(topUpstreams.WithLabelValues("test", "dns.google")); got != 5 {
+		t.Errorf("Expected collapsed upstream total 5, got %v", got)
+	}
+}
+
+func TestFetchStatsConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/stats/config" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"enabled":true,"interval":7776000000,"ignored":["example.com"]}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	cfg, err := NewClient(target{Host: srv.URL}).StatsConfig(context.Background())
+	if err != nil {
+		t.Fatalf("StatsConfig failed: %v", err)
+	}
+	updateStatsConfigMetrics("test", cfg)
+	if got := testutil.ToFloat64(statsRetentionDays.WithLabelValues("test")); got != 90 {
+		t.Errorf("Expected retention 90 days, got %v", got)
+	}
+	if got := testutil.ToFloat64(statsEnabled.WithLabelValues("test")); got != 1 {
+		t.Errorf("Expected stats enabled, got %v", got)
+	}
+	if got := testutil.ToFloat64(statsIntervalSeconds.WithLabelValues("test")); got != 90*86400 {
+		t.Errorf("Expected a 90 day stats interval in seconds, got %v", got)
+	}
+}
+
+func TestFetchStatsConfigFallsBackToStatsInfo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/stats_info" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"interval":0}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	cfg, err := NewClient(target{Host: srv.URL}).StatsConfig(context.Background())
+	if err != nil {
+		t.Fatalf("StatsConfig failed: %v", err)
+	}
+	if cfg.Enabled || cfg.Interval != 0 {
+		t.Errorf("Expected disabled stats from stats_info, got %+v", cfg)
+	}
+}
+
+func TestStatsIntervalFromDays(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/stats_info" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"interval":7}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	cfg, err := NewClient(target{Host: srv.URL}).StatsConfig(context.Background())
+	if err != nil {
+		t.Fatalf("StatsConfig failed: %v", err)
+	}
+	updateStatsConfigMetrics("test", cfg)
+	if got := testutil.ToFloat64(statsIntervalSeconds.WithLabelValues("test")); got != 7*86400 {
+		t.Errorf("Expected a 7 day stats interval in seconds, got %v", got)
+	}
+	if got := testutil.ToFloat64(statsRetentionDays.WithLabelValues("test")); got != 7 {
+		t.Errorf("Expected retention 7 days, got %v", got)
+	}
+}
+
+func TestRetryBudgetStopsRetriesWithinCycle(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	defer func(r, b int) { fetchRetries, retryBudgetSize = r, b; resetRetryBudget() }(fetchRetries, retryBudgetSize)
+	fetchRetries, retryBudgetSize = 3, 4
+	resetRetryBudget()
+
+	before := testutil.ToFloat64(retryBudgetExhausted)
+	var stats AdGuardStats
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "stats", "/control/stats", &stats); err == nil {
+		t.Fatalf("Expected fetch to fail")
+	}
+	if got := hits.Load(); got != 4 {
+		t.Errorf("Expected 1 attempt plus 3 retries, got %d requests", got)
+	}
+	if err := NewClient(target{Host: srv.URL}).fetchJSON(context.Background(), "status", "/control/status", &stats); err == nil {
+		t.Fatalf("Expected fetch to fail")
+	}
+	if got := hits.Load(); got != 6 {
+		t.Errorf("Expected the last retry of the budget to be used, got %d requests", got)
+	}
+	if got := testutil.ToFloat64(retryBudgetExhausted) - before; got != 1 {
+		t.Errorf("Expected budget exhaustion to be counted once, got %v", got)
+	}
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch hits.Add(1) {
+		case 1:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"num_dns_queries": 9}`))
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	defer func(r int) { fetchRetries = r; resetRetryBudget() }(fetchRetries)
+	fetchRetries = 3
+	resetRetryBudget()
+
+	stats, err := NewClient(target{Host: srv.URL}).Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the third attempt to succeed, got %v", err)
+	}
+	if stats.NumDNSQueries != 9 || hits.Load() != 3 {
+		t.Errorf("Expected 9 queries after 3 attempts, got %v after %d", stats.NumDNSQueries, hits.Load())
+	}
+}
+
+func TestNoRetryOnClientErrors(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	defer func(r int) { fetchRetries = r; resetRetryBudget() }(fetchRetries)
+	fetchRetries = 3
+	resetRetryBudget()
+
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got %v", err)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("Expected a 401 not to be retried, got %d requests", got)
+	}
+}
+
+func TestFetchCancelledMidRequest(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	resetRetryBudget()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := NewClient(target{Host: srv.URL}).Stats(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancellation error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the fetch to return promptly after cancellation, took %s", elapsed)
+	}
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = 100 * time.Millisecond
+	for attempt, base := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		if d := retryDelay(attempt); d < base/2 || d > base {
+			t.Errorf("Attempt %d: expected a delay in [%s, %s], got %s", attempt, base/2, base, d)
+		}
+	}
+	if d := retryDelay(30); d > maxRetryBackoff {
+		t.Errorf("Expected the delay to be capped at %s, got %s", maxRetryBackoff, d)
+	}
+}
+
+func TestScheduleBlocking(t *testing.T) {
+	var services AdGuardBlockedServices
+	payload := `{"ids":["youtube"],"schedule":{"time_zone":"UTC","mon":{"start":28800000,"end":57600000}}}`
+	if err := json.Unmarshal([]byte(payload), &services); err != nil {
+		t.Fatalf("Failed to decode blocked services: %v", err)
+	}
+
+	// 2024-05-06 is a Monday; the schedule pauses blocking from 08:00 to 16:00.
+	paused := time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC)
+	if scheduleBlocking(services.Schedule, paused) {
+		t.Errorf("Expected blocking to be paused at %s", paused)
+	}
+	for _, now := range []time.Time{
+		time.Date(2024, 5, 6, 16, 0, 0, 0, time.UTC),
+		time.Date(2024, 5, 6, 7, 59, 0, 0, time.UTC),
+		time.Date(2024, 5, 7, 10, 0, 0, 0, time.UTC),
+	} {
+		if !scheduleBlocking(services.Schedule, now) {
+			t.Errorf("Expected blocking to be active at %s", now)
+		}
+	}
+	if !scheduleBlocking(nil, paused) {
+		t.Errorf("Expected blocking to be active without a schedule")
+	}
+}
+
+// TestGroupMetricsBySubsystem re-runs itself with GROUP_METRICS_BY_SUBSYSTEM
+// set, since metric names are fixed when the package is initialised.
+func TestGroupMetricsBySubsystem(t *testing.T) {
+	if os.Getenv("GROUP_METRICS_BY_SUBSYSTEM") != "true" {
+		for _, c := range []prometheus.Collector{dnsQueries, statusRunning, queryCountByReason} {
+			if name := descName(c); strings.Contains(name, "adguard_stats_") || strings.Contains(name, "adguard_status_") {
+				t.Errorf("Expected flat metric names by default, got %s", name)
+			}
+		}
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestGroupMetricsBySubsystem$")
+		cmd.Env = append(os.Environ(), "GROUP_METRICS_BY_SUBSYSTEM=true")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Grouped run failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	expected := map[prometheus.Collector]string{
+		dnsQueries:           "adguard_stats_dns_queries_total",
+		topUpstreams:         "adguard_stats_top_upstream_total",
+		statusRunning:        "adguard_status_running",
+		versionInfo:          "adguard_status_version_info",
+		queryCountByReason:   "adguard_querylog_query_reason_total",
+		queryLogPagesFetched: "adguard_querylog_pages_fetched",
+		replicaQueryLag:      "adguard_replica_query_lag",
+	}
+	for c, want := range expected {
+		if got := descName(c); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+// TestMetricNamespace re-runs itself with METRIC_NAMESPACE set, since metric
+// names are fixed when the package is initialised.
+func TestMetricNamespace(t *testing.T) {
+	if os.Getenv("METRIC_NAMESPACE") == "" {
+		if got := descName(dnsQueries); got != "adguard_dns_queries_total" {
+			t.Errorf("Expected the adguard namespace by default, got %s", got)
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMetricNamespace$")
+		cmd.Env = append(os.Environ(), "METRIC_NAMESPACE=dns_home")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Namespaced run failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	expected := map[prometheus.Collector]string{
+		dnsQueries:         "dns_home_dns_queries_total",
+		queryCountByReason: "dns_home_query_reason_total",
+		apiRequestDuration: "dns_home_api_request_duration_seconds",
+		httpRequests:       "dns_home_exporter_http_requests_total",
+		adguardUp:          "dns_home_up",
+	}
+	for c, want := range expected {
+		if got := descName(c); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, mf := range mfs {
+		if name := mf.GetName(); strings.HasPrefix(name, "adguard_") {
+			t.Errorf("Expected every exposed metric to use the custom namespace, got %s", name)
+		}
+	}
+}
+
+func TestValidNamespace(t *testing.T) {
+	for ns, want := range map[string]bool{"adguard": true, "dns_home": true, "ns2": true, "_x": true, "2ns": false, "dns-home": false, "dns home": false} {
+		if got := validNamespace(ns); got != want {
+			t.Errorf("validNamespace(%q): expected %v, got %v", ns, want, got)
+		}
+	}
+}
+
+// descName returns the fully-qualified name of c's single metric descriptor.
+func descName(c prometheus.Collector) string {
+	ch := make(chan *prometheus.Desc, 1)
+	c.Describe(ch)
+	desc := (<-ch).String()
+	_, rest, _ := strings.Cut(desc, `fqName: "`)
+	name, _, _ := strings.Cut(rest, `"`)
+	return name
+}
+
+func TestParseHTTPTimeout(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":     defaultHTTPTimeout,
+		"30":   30 * time.Second,
+		"1":    time.Second,
+		"0":    defaultHTTPTimeout,
+		"-5":   defaultHTTPTimeout,
+		"fast": defaultHTTPTimeout,
+	}
+	for raw, want := range tests {
+		if got := parseHTTPTimeout(raw); got != want {
+			t.Errorf("ADGUARD_HTTP_TIMEOUT=%q: expected %v, got %v", raw, want, got)
+		}
+	}
+}
+
+func TestHTTPClientTimeoutApplied(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	defer func(d time.Duration) { httpClient.Timeout = d }(httpClient.Timeout)
+	httpClient.Timeout = 50 * time.Millisecond
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err == nil {
+		t.Errorf("Expected a request slower than the client timeout to fail")
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	payload := `{"clients":[
+		{"name":"laptop","ids":["192.168.1.20","aa:bb:cc:dd:ee:ff"],"use_global_settings":false,
+		 "filtering_enabled":true,"parental_enabled":true,"safebrowsing_enabled":false,
+		 "safe_search":{"enabled":false},"blocked_services":["tiktok"],"upstreams":[],"tags":["device_laptop"]},
+		{"name":"tv","ids":["192.168.1.30"],"use_global_settings":true,
+		 "filtering_enabled":false,"parental_enabled":false,"safebrowsing_enabled":true}
+	],"auto_clients":[{"name":"printer","ip":"192.168.1.40","source":"rDNS"}],"supported_tags":["device_laptop"]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+
+	clients, err := NewClient(target{Host: srv.URL}).Clients(context.Background())
+	if err != nil {
+		t.Fatalf("Clients failed: %v", err)
+	}
+	if len(clients.Clients) != 2 || len(clients.Clients[0].IDs) != 2 {
+		t.Fatalf("Unexpected clients: %+v", clients.Clients)
+	}
+	updateClientMetrics(srv.URL, clients)
+
+	if got := testutil.ToFloat64(clientInfo.WithLabelValues(srv.URL, "laptop", "192.168.1.20,aa:bb:cc:dd:ee:ff")); got != 1 {
+		t.Errorf("Expected client info with joined IDs, got %v", got)
+	}
+	toggles := map[string][2]float64{
+		"laptop filtering":    {testutil.ToFloat64(clientFilteringEnabled.WithLabelValues(srv.URL, "laptop")), 1},
+		"laptop parental":     {testutil.ToFloat64(clientParentalEnabled.WithLabelValues(srv.URL, "laptop")), 1},
+		"laptop safebrowsing": {testutil.ToFloat64(clientSafeBrowsingEnabled.WithLabelValues(srv.URL, "laptop")), 0},
+		"tv filtering":        {testutil.ToFloat64(clientFilteringEnabled.WithLabelValues(srv.URL, "tv")), 0},
+		"tv safebrowsing":     {testutil.ToFloat64(clientSafeBrowsingEnabled.WithLabelValues(srv.URL, "tv")), 1},
+		"tv global settings":  {testutil.ToFloat64(clientGlobalSettings.WithLabelValues(srv.URL, "tv")), 1},
+	}
+	for name, v := range toggles {
+		if v[0] != v[1] {
+			t.Errorf("Expected %s %v, got %v", name, v[1], v[0])
+		}
+	}
+
+	// A removed client must disappear on the next refresh.
+	updateClientMetrics(srv.URL, &AdGuardClients{Clients: clients.Clients[1:]})
+	if clientInfo.DeleteLabelValues(srv.URL, "laptop", "192.168.1.20,aa:bb:cc:dd:ee:ff") {
+		t.Errorf("Expected the removed client's info series to be dropped")
+	}
+}
+
+func TestFetchAs(t *testing.T) {
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/broken": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		},
+	})
+
+	status, err := fetchAs[AdGuardStatus](context.Background(), NewClient(target{Host: srv.URL}), "status", "/control/status")
+	if err != nil {
+		t.Fatalf("fetchAs failed: %v", err)
+	}
+	if status.Version != "v0.107.52" || status.DNSPort != 53 {
+		t.Errorf("Unexpected decoded status: %+v", status)
+	}
+
+	if v, err := fetchAs[AdGuardStatus](context.Background(), NewClient(target{Host: srv.URL}), "broken", "/control/broken"); err == nil || v != nil {
+		t.Errorf("Expected a 404 to return an error and no value, got %v / %v", v, err)
+	}
+}
+
+func TestHTMLResponseGivesClearError(t *testing.T) {
+	loginPage := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<!DOCTYPE html><html><body>Sign in</body></html>"))
+	}
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats": loginPage,
+		"/control/status": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/login", http.StatusFound)
+		},
+		"/login": loginPage,
+		"/control/dhcp/status": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("<html>502 Bad Gateway</html>"))
+		},
+	})
+
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err == nil || err.Error() != "expected JSON from /control/stats, got text/html (status 200)" {
+		t.Errorf("Expected a clear error for an HTML page, got %v", err)
+	}
+	if _, err := NewClient(target{Host: srv.URL}).Status(context.Background()); err == nil || !strings.Contains(err.Error(), "expected JSON from /control/status, got text/html") ||
+		!strings.Contains(err.Error(), "redirect to "+srv.URL+"/login") {
+		t.Errorf("Expected the error to name the redirect, got %v", err)
+	}
+	if _, err := NewClient(target{Host: srv.URL}).DHCP(context.Background()); err == nil || !strings.Contains(err.Error(), "got text/plain (status 502)") {
+		t.Errorf("Expected a mislabelled HTML error page to be recognised, got %v", err)
+	}
+}
+
+func TestRewriteMetrics(t *testing.T) {
+	rewrites := `[{"domain":"nas.home","answer":"192.168.1.5"},{"domain":"*.lab.home","answer":"lab.home"}]`
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/rewrite/list": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(rewrites))
+		},
+	})
+
+	list, err := NewClient(target{Host: srv.URL}).Rewrites(context.Background())
+	if err != nil {
+		t.Fatalf("Rewrites failed: %v", err)
+	}
+	if len(list) != 2 || list[1].Domain != "*.lab.home" || list[1].Answer != "lab.home" {
+		t.Fatalf("Unexpected rewrites: %+v", list)
+	}
+	updateRewriteMetrics(srv.URL, list)
+	if got := testutil.ToFloat64(dnsRewrites.WithLabelValues(srv.URL)); got != 2 {
+		t.Errorf("Expected 2 rewrites, got %v", got)
+	}
+	if got := testutil.ToFloat64(dnsRewriteInfo.WithLabelValues(srv.URL, "nas.home", "192.168.1.5")); got != 1 {
+		t.Errorf("Expected rewrite info for nas.home, got %v", got)
+	}
+
+	rewrites = `[]`
+	updateMetrics(context.Background())
+	if got := testutil.ToFloat64(dnsRewrites.WithLabelValues(srv.URL)); got != 0 {
+		t.Errorf("Expected 0 rewrites for an empty list, got %v", got)
+	}
+	if n := testutil.CollectAndCount(dnsRewriteInfo); n != 0 {
+		t.Errorf("Expected the rewrite info to be cleared, got %d series", n)
+	}
+}
+
+func TestBlockedServiceEnabled(t *testing.T) {
+	shapes := map[string]map[string]http.HandlerFunc{
+		"v0.107.37+": {
+			"/control/blocked_services/get": func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"ids":["youtube","tiktok"],"schedule":{"time_zone":"UTC"}}`))
+			},
+		},
+		"older": {
+			"/control/blocked_services/get": http.NotFound,
+			"/control/blocked_services/list": func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`["youtube","tiktok"]`))
+			},
+		},
+	}
+	for version, overrides := range shapes {
+		blockedServiceEnabled.Reset()
+		srv := newFakeAdGuard(t, overrides)
+		services, err := NewClient(target{Host: srv.URL}).BlockedServices(context.Background())
+		if err != nil {
+			t.Fatalf("%s: BlockedServices failed: %v", version, err)
+		}
+		updateBlockedServicesMetrics(srv.URL, services)
+
+		for _, service := range []string{"youtube", "tiktok"} {
+			if got := testutil.ToFloat64(blockedServiceEnabled.WithLabelValues(srv.URL, service)); got != 1 {
+				t.Errorf("%s: expected %s to be blocked, got %v", version, service, got)
+			}
+		}
+		updateBlockedServicesMetrics(srv.URL, &AdGuardBlockedServices{IDs: []string{"youtube"}})
+		if n := testutil.CollectAndCount(blockedServiceEnabled); n != 1 {
+			t.Errorf("%s: expected unblocked services to be dropped, got %d series", version, n)
+		}
+	}
+}
+
+func TestBlockedServicesFallbackOnlyOn404(t *testing.T) {
+	listCalls := 0
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/blocked_services/get": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		},
+		"/control/blocked_services/list": func(w http.ResponseWriter, r *http.Request) {
+			listCalls++
+			w.Write([]byte(`["youtube"]`))
+		},
+	})
+	_, err := NewClient(target{Host: srv.URL}).BlockedServices(context.Background())
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusForbidden {
+		t.Errorf("Expected the 403 from /get to be returned, got %v", err)
+	}
+	if listCalls != 0 {
+		t.Errorf("Expected no fallback to /list, got %d calls", listCalls)
+	}
+}
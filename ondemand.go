@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// onDemandScrape is set when SCRAPE_MODE=ondemand: AdGuard is fetched when
+// /metrics is requested instead of on a fixed SCRAPE_INTERVAL.
+var onDemandScrape = false
+
+// onDemand is the collector refreshing the metrics in SCRAPE_MODE=ondemand.
+var onDemand *onDemandCollector
+
+func parseScrapeMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", "interval":
+		return false
+	case "ondemand":
+		return true
+	}
+	logX("WARN", "Unknown SCRAPE_MODE %q, using interval", mode)
+	return false
+}
+
+// scrapeOnce runs one full update cycle, saves STATE_FILE and records how long
+// it took. It is the unit of work of both scrape modes.
+func scrapeOnce(ctx context.Context) {
+	start := time.Now()
+	updateMetrics(ctx)
+	if stateFile := os.Getenv("STATE_FILE"); stateFile != "" {
+		if err := saveState(stateFile); err != nil {
+			logX("WARN", "Failed to save state to %s: %v", stateFile, err)
+		}
+	}
+	scrapeDuration.Set(time.Since(start).Seconds())
+}
+
+// onDemandCollector wraps the exporter's collectors and refreshes them from
+// AdGuard before each collection. Concurrent collections share a single
+// refresh, and a collection waits at most timeout for it before serving the
+// previous values; the refresh keeps running for the next collection to join.
+// Served through cancelOnAbort, the refresh is cancelled when every /metrics
+// request waiting for it has been aborted.
+type onDemandCollector struct {
+	collectors []prometheus.Collector
+	timeout    time.Duration
+	scrape     func(context.Context)
+
+	mu       sync.Mutex
+	inflight chan struct{}
+	cancel   context.CancelFunc
+	// active and aborted count the requests being served and those among
+	// them whose client went away.
+	active, aborted int
+}
+
+func newOnDemandCollector(timeout time.Duration, collectors ...prometheus.Collector) *onDemandCollector {
+	return &onDemandCollector{collectors: collectors, timeout: timeout, scrape: scrapeOnce}
+}
+
+func (c *onDemandCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, col := range c.collectors {
+		col.Describe(ch)
+	}
+}
+
+func (c *onDemandCollector) Collect(ch chan<- prometheus.Metric) {
+	select {
+	case <-c.refresh():
+	case <-time.After(c.timeout):
+		logX("WARN", "On-demand scrape still running after %s, serving previous values", c.timeout)
+	}
+	for _, col := range c.collectors {
+		col.Collect(ch)
+	}
+}
+
+// refresh starts a scrape unless one is already running and returns a channel
+// closed when the running scrape finishes.
+func (c *onDemandCollector) refresh() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight != nil {
+		return c.inflight
+	}
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.inflight, c.cancel = done, cancel
+	go func() {
+		c.scrape(ctx)
+		c.mu.Lock()
+		c.inflight, c.cancel = nil, nil
+		c.mu.Unlock()
+		cancel()
+		close(done)
+	}()
+	return done
+}
+
+// cancelOnAbort wraps the /metrics handler so that a Prometheus scrape that
+// times out or is cancelled stops the AdGuard requests made on its behalf. A
+// refresh shared with a request that is still waiting keeps running.
+func (c *onDemandCollector) cancelOnAbort(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.active++
+		c.mu.Unlock()
+
+		aborted := false
+		fired := make(chan struct{})
+		stop := context.AfterFunc(r.Context(), func() {
+			defer close(fired)
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			aborted = true
+			c.aborted++
+			if c.aborted == c.active && c.cancel != nil {
+				logX("WARN", "Scrape request aborted, cancelling the on-demand scrape")
+				c.cancel()
+			}
+		})
+
+		next.ServeHTTP(w, r)
+
+		if !stop() {
+			<-fired
+		}
+		c.mu.Lock()
+		c.active--
+		if aborted {
+			c.aborted--
+		}
+		c.mu.Unlock()
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseScrapeMode(t *testing.T) {
+	for mode, want := range map[string]bool{"": false, "interval": false, "ondemand": true, "OnDemand": true, "bogus": false} {
+		if got := parseScrapeMode(mode); got != want {
+			t.Errorf("SCRAPE_MODE=%q: expected %v, got %v", mode, want, got)
+		}
+	}
+}
+
+func TestOnDemandCollectorRefreshesOnCollect(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ondemand_test_value", Help: "test"})
+	var scrapes atomic.Int64
+	c := newOnDemandCollector(time.Second, g)
+	c.scrape = func(context.Context) { g.Set(float64(scrapes.Add(1))) }
+
+	for want := 1.0; want <= 2; want++ {
+		if got := testutil.ToFloat64(c); got != want {
+			t.Errorf("Expected a fresh value %v on collect, got %v", want, got)
+		}
+	}
+}
+
+func TestOnDemandCollectorSharesConcurrentScrapes(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ondemand_test_value", Help: "test"})
+	var scrapes atomic.Int64
+	release := make(chan struct{})
+	c := newOnDemandCollector(time.Second, g)
+	c.scrape = func(context.Context) {
+		scrapes.Add(1)
+		<-release
+		g.Set(42)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := testutil.ToFloat64(c); got != 42 {
+				t.Errorf("Expected the shared scrape's value, got %v", got)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := scrapes.Load(); n != 1 {
+		t.Errorf("Expected concurrent collections to share one scrape, got %d", n)
+	}
+}
+
+func TestOnDemandCollectorServesPreviousValuesOnTimeout(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ondemand_test_value", Help: "test"})
+	g.Set(7)
+	release := make(chan struct{})
+	defer close(release)
+	c := newOnDemandCollector(20*time.Millisecond, g)
+	c.scrape = func(context.Context) { <-release }
+
+	if got := testutil.ToFloat64(c); got != 7 {
+		t.Errorf("Expected the previous value while AdGuard is slow, got %v", got)
+	}
+}
+
+func TestOnDemandCollectorCancelsOnAbort(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ondemand_test_value", Help: "test"})
+	cancelled := make(chan struct{})
+	c := newOnDemandCollector(5*time.Second, g)
+	c.scrape = func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	}
+	h := c.cancelOnAbort(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.CollectAndCount(c)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil).WithContext(ctx))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the aborted request to cancel the on-demand scrape")
+	}
+	<-served
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queryLogWorkers is the number of goroutines aggregating querylog entries
+// (QUERYLOG_WORKERS). 1 processes the log serially.
+var queryLogWorkers = 1
+
+// upstreamSlowThresholdMs is the elapsed time above which a forwarded query
+// counts towards adguard_upstream_slow_total (UPSTREAM_SLOW_THRESHOLD_MS).
+var upstreamSlowThresholdMs = 500.0
+
+// clientObservation is one entry's latency for the per-client and per-type histograms.
+type clientObservation struct {
+	client    string
+	qtype     string
+	upstream  string
+	elapsedMs float64
+}
+
+// queryLogAggregate holds the per-label totals of a batch of querylog entries.
+// Entries are aggregated first and applied to the Prometheus vecs once, so each
+// label combination is only looked up once per scrape and workers never
+// contend on the vecs' locks.
+type queryLogAggregate struct {
+	total  float64
+	cached float64
+
+	types     map[string]float64
+	rcodes    map[string]float64
+	protos    map[string]float64
+	answered  map[string]float64
+	upstreams map[string]float64
+	// upstreamSlow and upstreamErrors count forwarded queries per upstream.
+	upstreamSlow   map[string]float64
+	upstreamErrors map[string]float64
+	domains        map[string]float64
+	tlds           map[string]float64
+	rewrites       map[string]float64
+	services       map[string]float64
+	filters        map[string]float64
+	// incomplete counts blank key fields by field name.
+	incomplete map[string]float64
+	// clientReasons also yields the per-reason totals.
+	clientReasons map[[2]string]float64
+	// elapsed keeps the latency observations in entry order.
+	elapsed           []clientObservation
+	upstreamsByClient map[string]map[string]struct{}
+	blockedAnswers    map[[2]string]struct{}
+	// lastSeen is the newest entry timestamp per client.
+	lastSeen map[string]time.Time
+}
+
+func newQueryLogAggregate(size int) *queryLogAggregate {
+	return &queryLogAggregate{
+		elapsed:           make([]clientObservation, 0, size),
+		types:             map[string]float64{},
+		rcodes:            map[string]float64{},
+		protos:            map[string]float64{},
+		answered:          map[string]float64{},
+		upstreams:         map[string]float64{},
+		upstreamSlow:      map[string]float64{},
+		upstreamErrors:    map[string]float64{},
+		domains:           map[string]float64{},
+		tlds:              map[string]float64{},
+		rewrites:          map[string]float64{},
+		services:          map[string]float64{},
+		filters:           map[string]float64{},
+		incomplete:        map[string]float64{},
+		clientReasons:     map[[2]string]float64{},
+		upstreamsByClient: map[string]map[string]struct{}{},
+		blockedAnswers:    map[[2]string]struct{}{},
+		lastSeen:          map[string]time.Time{},
+	}
+}
+
+func (a *queryLogAggregate) add(q QueryLogEntry) {
+	a.total++
+	if q.Cached {
+		a.cached++
+	}
+	if tldMetrics {
+		a.tlds[tldLabel(q.Question.Name)]++
+	}
+	for _, field := range missingFields(q) {
+		a.incomplete[field]++
+	}
+	q.Client = sanitizeLabel(q.Client)
+	q.Upstream = upstreamLabel(q.Upstream)
+	q.Question.Name = sanitizeLabel(q.Question.Name)
+
+	reason := reasonLabel(q.Reason)
+	forwarded := !q.Cached && strings.HasPrefix(q.Reason, "NotFiltered")
+	a.types[q.Question.Type]++
+	a.rcodes[rcodeLabel(q.Status)]++
+	a.protos[protoLabel(q.ClientProto)]++
+	a.answered[strconv.FormatBool(hasAnswer(q.Answer))]++
+	elapsedMs, err := strconv.ParseFloat(q.Elapsed, 64)
+	if err == nil {
+		a.elapsed = append(a.elapsed, clientObservation{q.Client, q.Question.Type, q.Upstream, elapsedMs})
+		if forwarded && q.Upstream != "" && elapsedMs > upstreamSlowThresholdMs {
+			a.upstreamSlow[q.Upstream]++
+		}
+	} else {
+		logX("WARN", "Failed to parse elapsedMs: %v", err)
+	}
+	a.upstreams[q.Upstream]++
+	if upstreamFailed(q) {
+		a.upstreamErrors[q.Upstream]++
+	}
+	a.domains[q.Question.Name]++
+	a.clientReasons[[2]string{q.Client, reason}]++
+	// Rewrite, RewriteEtcHosts and RewriteRule are all answered by a rewrite.
+	if strings.HasPrefix(q.Reason, "Rewrite") {
+		a.rewrites[q.Question.Name]++
+	}
+	if q.Reason == "FilteredBlockedService" {
+		service := q.ServiceName
+		if service == "" {
+			service = "unknown"
+		}
+		a.services[service]++
+	}
+	if strings.HasPrefix(q.Reason, "Filtered") {
+		for _, id := range filterIDs(q) {
+			a.filters[id]++
+		}
+	}
+	if blockedAnswerInfo && strings.HasPrefix(q.Reason, "Filtered") {
+		for _, rec := range answerRecords(q.Answer) {
+			a.blockedAnswers[rec] = struct{}{}
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, q.Time); err == nil && t.After(a.lastSeen[q.Client]) {
+		a.lastSeen[q.Client] = t
+	}
+	if q.Upstream != "" {
+		if a.upstreamsByClient[q.Client] == nil {
+			a.upstreamsByClient[q.Client] = map[string]struct{}{}
+		}
+		a.upstreamsByClient[q.Client][q.Upstream] = struct{}{}
+	}
+}
+
+// filterIDs returns the distinct filter lists whose rules matched q, read from
+// the rules array of newer AdGuard versions or the single rule of older ones.
+func filterIDs(q QueryLogEntry) []string {
+	var ids []string
+	seen := map[int64]bool{}
+	for _, r := range q.Rules {
+		if !seen[r.FilterListID] {
+			seen[r.FilterListID] = true
+			ids = append(ids, strconv.FormatInt(r.FilterListID, 10))
+		}
+	}
+	if len(q.Rules) == 0 && q.Rule != "" {
+		ids = append(ids, strconv.FormatInt(q.FilterID, 10))
+	}
+	return ids
+}
+
+// hasAnswer reports whether a querylog answer holds at least one record. The
+// answer's shape differs between record types and AdGuard versions, so any
+// non-empty element counts: an object with fields, a string, a number.
+func hasAnswer(answer []interface{}) bool {
+	for _, a := range answer {
+		switch v := a.(type) {
+		case nil:
+		case map[string]interface{}:
+			if len(v) > 0 {
+				return true
+			}
+		case string:
+			if v != "" {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamFailed reports whether q failed at its upstream: AdGuard records
+// NotFilteredError when resolving fails, and an upstream SERVFAIL is passed on
+// as the response code of a forwarded query.
+func upstreamFailed(q QueryLogEntry) bool {
+	if q.Reason == "NotFilteredError" {
+		return true
+	}
+	return !q.Cached && strings.HasPrefix(q.Reason, "NotFiltered") && strings.EqualFold(q.Status, "SERVFAIL")
+}
+
+// missingFields returns the key fields left blank in q. Upstream is only
+// expected for queries AdGuard actually forwarded, i.e. neither answered from
+// cache nor by a filter or rewrite.
+func missingFields(q QueryLogEntry) []string {
+	var missing []string
+	if q.Client == "" {
+		missing = append(missing, "client")
+	}
+	if q.Question.Name == "" {
+		missing = append(missing, "question_name")
+	}
+	if q.Question.Type == "" {
+		missing = append(missing, "question_type")
+	}
+	if q.Reason == "" {
+		missing = append(missing, "reason")
+	}
+	if q.Time == "" {
+		missing = append(missing, "time")
+	}
+	forwarded := !q.Cached && strings.HasPrefix(q.Reason, "NotFiltered")
+	if q.Upstream == "" && forwarded {
+		missing = append(missing, "upstream")
+	}
+	return missing
+}
+
+func addCounts[K comparable](dst, src map[K]float64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// merge folds o into a. Merging in chunk order keeps the observations in the
+// same order as a serial pass.
+func (a *queryLogAggregate) merge(o *queryLogAggregate) {
+	a.total += o.total
+	a.cached += o.cached
+	addCounts(a.types, o.types)
+	addCounts(a.rcodes, o.rcodes)
+	addCounts(a.protos, o.protos)
+	addCounts(a.answered, o.answered)
+	addCounts(a.upstreams, o.upstreams)
+	addCounts(a.upstreamSlow, o.upstreamSlow)
+	addCounts(a.upstreamErrors, o.upstreamErrors)
+	addCounts(a.domains, o.domains)
+	addCounts(a.tlds, o.tlds)
+	addCounts(a.rewrites, o.rewrites)
+	addCounts(a.services, o.services)
+	addCounts(a.filters, o.filters)
+	addCounts(a.incomplete, o.incomplete)
+	addCounts(a.clientReasons, o.clientReasons)
+	a.elapsed = append(a.elapsed, o.elapsed...)
+	for client, upstreams := range o.upstreamsByClient {
+		if a.upstreamsByClient[client] == nil {
+			a.upstreamsByClient[client] = map[string]struct{}{}
+		}
+		for up := range upstreams {
+			a.upstreamsByClient[client][up] = struct{}{}
+		}
+	}
+	for rec := range o.blockedAnswers {
+		a.blockedAnswers[rec] = struct{}{}
+	}
+	for client, t := range o.lastSeen {
+		if t.After(a.lastSeen[client]) {
+			a.lastSeen[client] = t
+		}
+	}
+}
+
+// aggregateQueryLog aggregates entries using up to workers goroutines, each
+// handling a contiguous chunk of the log.
+func aggregateQueryLog(entries []QueryLogEntry, workers int) *queryLogAggregate {
+	if workers <= 1 || len(entries) < 2*workers {
+		agg := newQueryLogAggregate(len(entries))
+		for _, q := range entries {
+			agg.add(q)
+		}
+		return agg
+	}
+
+	chunk := (len(entries) + workers - 1) / workers
+	parts := make([]*queryLogAggregate, workers)
+	var wg sync.WaitGroup
+	for i := range parts {
+		lo, hi := i*chunk, min((i+1)*chunk, len(entries))
+		if lo >= hi {
+			break
+		}
+		wg.Add(1)
+		scrapeGoroutines.Inc()
+		go func(i int, batch []QueryLogEntry) {
+			defer wg.Done()
+			defer scrapeGoroutines.Dec()
+			agg := newQueryLogAggregate(len(batch))
+			for _, q := range batch {
+				agg.add(q)
+			}
+			parts[i] = agg
+		}(i, entries[lo:hi])
+	}
+	wg.Wait()
+
+	total := newQueryLogAggregate(len(entries))
+	for _, p := range parts {
+		if p != nil {
+			total.merge(p)
+		}
+	}
+	return total
+}
+
+// exemplarLabels returns the exemplar for o's latency observation, or nil when
+// exemplars are disabled. The upstream is left out, and then the exemplar
+// altogether, if the labels would exceed Prometheus' rune limit.
+func exemplarLabels(o clientObservation) prometheus.Labels {
+	if !exemplarsEnabled {
+		return nil
+	}
+	size := func(l prometheus.Labels) int {
+		n := 0
+		for k, v := range l {
+			n += utf8.RuneCountInString(k) + utf8.RuneCountInString(v)
+		}
+		return n
+	}
+	labels := prometheus.Labels{"client": o.client}
+	if o.upstream != "" {
+		labels["upstream"] = o.upstream
+	}
+	if size(labels) > prometheus.ExemplarMaxRunes {
+		delete(labels, "upstream")
+	}
+	if size(labels) > prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	return labels
+}
+
+// sortedKeys returns the keys of m in order so capped labels are admitted
+// deterministically.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// apply adds the aggregated totals to instance's querylog metrics. In
+// BLOCKED_ONLY_MODE only the block-oriented metrics are updated; the rest
+// would describe blocked traffic alone and be misleading.
+func (a *queryLogAggregate) apply(instance string) {
+	reasons := map[string]float64{}
+	for key, n := range a.clientReasons {
+		reasons[key[1]] += n
+	}
+	for reason, n := range reasons {
+		queryCountByReason.WithLabelValues(instance, reason).Add(n)
+	}
+	for key, n := range a.clientReasons {
+		queryCountClientReason.WithLabelValues(instance, key[0], key[1]).Add(n)
+	}
+	for service, n := range a.services {
+		blockedServices.WithLabelValues(instance, service).Add(n)
+	}
+	for id, n := range a.filters {
+		queryBlockedByFilter.WithLabelValues(instance, id).Add(n)
+	}
+	for field, n := range a.incomplete {
+		queryLogIncomplete.WithLabelValues(instance, field).Add(n)
+	}
+	if blockedAnswerInfo {
+		blockedCustomAnswer.DeletePartialMatch(prometheus.Labels{"instance": instance})
+		for rec := range a.blockedAnswers {
+			blockedCustomAnswer.WithLabelValues(instance, rec[0], rec[1]).Set(1)
+		}
+	}
+
+	// Everything below counts all queries, so it would silently turn into a
+	// blocked-only count from BLOCKED_ONLY_MODE's filtered querylog.
+	if blockedOnlyMode {
+		return
+	}
+
+	for typ, n := range a.types {
+		queryCountByType.WithLabelValues(instance, typ).Add(n)
+	}
+	for domain, n := range a.domains {
+		queryCountByDomain.WithLabelValues(instance, domain).Add(n)
+	}
+	for _, tld := range sortedKeys(a.tlds) {
+		queryCountByTLD.WithLabelValues(instance, tldCap.value(tld)).Add(a.tlds[tld])
+	}
+
+	if a.total > 0 {
+		cacheHitRatio.WithLabelValues(instance).Set(a.cached / a.total)
+	} else {
+		cacheHitRatio.WithLabelValues(instance).Set(0)
+	}
+	for rcode, n := range a.rcodes {
+		queryCountByRcode.WithLabelValues(instance, rcode).Add(n)
+	}
+	for proto, n := range a.protos {
+		queryCountByProto.WithLabelValues(instance, proto).Add(n)
+	}
+	for answered, n := range a.answered {
+		queryAnswered.WithLabelValues(instance, answered).Add(n)
+	}
+	for up, n := range a.upstreams {
+		queryCountByUpstream.WithLabelValues(instance, up).Add(n)
+	}
+	for up, n := range a.upstreamSlow {
+		upstreamSlow.WithLabelValues(instance, up).Add(n)
+	}
+	for up, n := range a.upstreamErrors {
+		upstreamErrors.WithLabelValues(instance, up).Add(n)
+	}
+	for _, domain := range sortedKeys(a.rewrites) {
+		rewriteHits.WithLabelValues(instance, rewriteDomainCap.value(domain)).Add(a.rewrites[domain])
+	}
+	observers := map[string]prometheus.Observer{}
+	typeObservers := map[string]prometheus.Observer{}
+	for _, o := range a.elapsed {
+		h, ok := observers[o.client]
+		if !ok {
+			h = queryHistogramByClient.WithLabelValues(instance, o.client)
+			observers[o.client] = h
+		}
+		if labels := exemplarLabels(o); labels != nil {
+			h.(prometheus.ExemplarObserver).ObserveWithExemplar(o.elapsedMs, labels)
+		} else {
+			h.Observe(o.elapsedMs)
+		}
+		th, ok := typeObservers[o.qtype]
+		if !ok {
+			th = queryHistogramByType.WithLabelValues(instance, o.qtype)
+			typeObservers[o.qtype] = th
+		}
+		th.Observe(o.elapsedMs)
+	}
+
+	capped := map[string]map[string]struct{}{}
+	for _, client := range sortedKeys(a.upstreamsByClient) {
+		label := clientCap.value(client)
+		if capped[label] == nil {
+			capped[label] = map[string]struct{}{}
+		}
+		for up := range a.upstreamsByClient[client] {
+			capped[label][up] = struct{}{}
+		}
+	}
+	clientUpstreamCount.DeletePartialMatch(prometheus.Labels{"instance": instance})
+	for client, upstreams := range capped {
+		clientUpstreamCount.WithLabelValues(instance, client).Set(float64(len(upstreams)))
+	}
+
+	for _, client := range sortedKeys(a.lastSeen) {
+		label := clientCap.value(client)
+		key := [2]string{instance, label}
+		if t := a.lastSeen[client]; t.After(clientLastSeenTimes[key]) {
+			clientLastSeenTimes[key] = t
+			clientLastSeen.WithLabelValues(instance, label).Set(float64(t.UnixNano()) / 1e9)
+		}
+	}
+	pruneClientLastSeen(time.Now())
+}
+
+// clientLastSeenTTL is how long a client may go unseen before its
+// adguard_client_last_seen_timestamp_seconds series is dropped
+// (CLIENT_LAST_SEEN_TTL).
+var clientLastSeenTTL = 24 * time.Hour
+
+// clientLastSeenTimes mirrors adguard_client_last_seen_timestamp_seconds,
+// keyed by instance and client, so timestamps only move forward and stale
+// clients can be found.
+var clientLastSeenTimes = map[[2]string]time.Time{}
+
+func pruneClientLastSeen(now time.Time) {
+	for key, t := range clientLastSeenTimes {
+		if now.Sub(t) > clientLastSeenTTL {
+			delete(clientLastSeenTimes, key)
+			clientLastSeen.DeleteLabelValues(key[0], key[1])
+		}
+	}
+}
+
+func processQueryLog(instance string, entries []QueryLogEntry) {
+	aggregateQueryLog(entries, queryLogWorkers).apply(instance)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAggregateQueryLogParallelMatchesSerial(t *testing.T) {
+	entries := syntheticQueryLog(10007)
+
+	serial := aggregateQueryLog(entries, 1)
+	for _, workers := range []int{2, 3, 8} {
+		if parallel := aggregateQueryLog(entries, workers); !reflect.DeepEqual(serial, parallel) {
+			t.Errorf("Aggregate with %d workers differs from the serial aggregate", workers)
+		}
+	}
+	if got := serial.rewrites["host2.example.com"]; got != 51 {
+		t.Errorf("Expected 51 rewrites of host2.example.com, got %v", got)
+	}
+}
+
+func benchmarkProcessQueryLog(b *testing.B, workers int) {
+	defer func(n int) { queryLogWorkers = n }(queryLogWorkers)
+	queryLogWorkers = workers
+	entries := syntheticQueryLog(100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processQueryLog("test", entries)
+	}
+}
+
+func BenchmarkProcessQueryLogSerial(b *testing.B) { benchmarkProcessQueryLog(b, 1) }
+
+func BenchmarkProcessQueryLogParallel(b *testing.B) {
+	benchmarkProcessQueryLog(b, runtime.GOMAXPROCS(0))
+}
+
+func TestCacheHitRatio(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"cached":true},{"cached":true},{"cached":true},
+		{"cached":false},{},{},{},{}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+
+	processQueryLog("test", logData.Data)
+	if got := testutil.ToFloat64(cacheHitRatio.WithLabelValues("test")); got != 0.375 {
+		t.Errorf("Expected cache hit ratio 0.375, got %v", got)
+	}
+
+	processQueryLog("test", nil)
+	if got := testutil.ToFloat64(cacheHitRatio.WithLabelValues("test")); got != 0 {
+		t.Errorf("Expected cache hit ratio 0 for an empty window, got %v", got)
+	}
+}
+
+func TestScrapeGoroutinesReturnToZero(t *testing.T) {
+	defer func(n int) { queryLogWorkers = n }(queryLogWorkers)
+	queryLogWorkers = 4
+
+	processQueryLog("test", syntheticQueryLog(1000))
+	if got := testutil.ToFloat64(scrapeGoroutines); got != 0 {
+		t.Errorf("Expected no scrape goroutines after processing, got %v", got)
+	}
+}
+
+func TestClientLastSeenTracksLatestEntry(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	defer func(d time.Duration) { clientLastSeenTTL = d }(clientLastSeenTTL)
+	clientLastSeenTTL = time.Since(base) + time.Hour
+
+	entry := func(client string, ts time.Time) QueryLogEntry {
+		var q QueryLogEntry
+		q.Client = client
+		q.Time = ts.Format(time.RFC3339Nano)
+		return q
+	}
+	processQueryLog("test", []QueryLogEntry{
+		entry("10.9.9.1", base.Add(2*time.Second)),
+		entry("10.9.9.1", base),
+		entry("10.9.9.2", base),
+	})
+	processQueryLog("test", []QueryLogEntry{entry("10.9.9.1", base.Add(5*time.Second))})
+	// An older window must not move the timestamp backwards.
+	processQueryLog("test", []QueryLogEntry{entry("10.9.9.1", base.Add(time.Second))})
+
+	want := float64(base.Add(5 * time.Second).Unix())
+	if got := testutil.ToFloat64(clientLastSeen.WithLabelValues("test", "10.9.9.1")); got != want {
+		t.Errorf("Expected last seen %v, got %v", want, got)
+	}
+
+	clientLastSeenTTL = time.Minute
+	pruneClientLastSeen(base.Add(2 * time.Minute))
+	for _, client := range []string{"10.9.9.1", "10.9.9.2"} {
+		if _, ok := clientLastSeenTimes[[2]string{"test", client}]; ok {
+			t.Errorf("Expected stale client %s to be dropped", client)
+		}
+	}
+}
+
+func TestQueryLogIncompleteEntries(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"question":{"type":"A","name":"ok.example"},"client":"10.0.0.1","reason":"NotFilteredNotFound","upstream":"1.1.1.1:53","time":"2024-05-01T12:00:00Z"},
+		{"question":{"type":"A","name":"cached.example"},"client":"10.0.0.1","reason":"NotFilteredNotFound","cached":true,"time":"2024-05-01T12:00:00Z"},
+		{"question":{"type":"A","name":"blocked.example"},"client":"10.0.0.1","reason":"FilteredBlackList","time":"2024-05-01T12:00:00Z"},
+		{"question":{"type":"A","name":"noupstream.example"},"client":"","reason":"NotFilteredNotFound","time":"2024-05-01T12:00:00Z"},
+		{"question":{},"client":"10.0.0.1","reason":"NotFilteredNotFound","upstream":"1.1.1.1:53"}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+
+	fields := []string{"client", "question_name", "question_type", "reason", "time", "upstream"}
+	before := map[string]float64{}
+	for _, f := range fields {
+		before[f] = testutil.ToFloat64(queryLogIncomplete.WithLabelValues("test", f))
+	}
+	processQueryLog("test", logData.Data)
+
+	expected := map[string]float64{"client": 1, "question_name": 1, "question_type": 1, "reason": 0, "time": 1, "upstream": 1}
+	for _, f := range fields {
+		if got := testutil.ToFloat64(queryLogIncomplete.WithLabelValues("test", f)) - before[f]; got != expected[f] {
+			t.Errorf("Expected %v incomplete %s entries, got %v", expected[f], f, got)
+		}
+	}
+}
+
+func TestQueryElapsedByType(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"client":"10.0.0.1","elapsedMs":"1.5","question":{"name":"a.example.com","type":"A"}},
+		{"client":"10.0.0.2","elapsedMs":"2","question":{"name":"b.example.com","type":"A"}},
+		{"client":"10.0.0.1","elapsedMs":"40","question":{"name":"c.example.com","type":"HTTPS"}},
+		{"client":"10.0.0.1","elapsedMs":"3","question":{"name":"c.example.com","type":"AAAA"}}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+	queryHistogramByType.DeletePartialMatch(map[string]string{"instance": "by-type"})
+
+	processQueryLog("by-type", logData.Data)
+
+	for qtype, want := range map[string]uint64{"A": 2, "AAAA": 1, "HTTPS": 1, "PTR": 0} {
+		if got := histogramCount(t, queryHistogramByType.WithLabelValues("by-type", qtype)); got != want {
+			t.Errorf("Expected %d observations for %s, got %d", want, qtype, got)
+		}
+	}
+}
+
+func TestQueryAnswered(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"status":"NOERROR","answer":[{"type":"A","value":"93.184.216.34","ttl":300}]},
+		{"status":"NOERROR","answer":[{"type":"HTTPS","value":{"priority":1},"ttl":300}]},
+		{"status":"NOERROR","answer":["raw record"]},
+		{"status":"NXDOMAIN","answer":[]},
+		{"status":"SERVFAIL"},
+		{"status":"NOERROR","answer":[null,{}]}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+	before := map[string]float64{}
+	for _, answered := range []string{"true", "false"} {
+		before[answered] = testutil.ToFloat64(queryAnswered.WithLabelValues("test", answered))
+	}
+
+	processQueryLog("test", logData.Data)
+
+	for answered, want := range map[string]float64{"true": 3, "false": 3} {
+		if got := testutil.ToFloat64(queryAnswered.WithLabelValues("test", answered)) - before[answered]; got != want {
+			t.Errorf("Expected %v entries with answered=%s, got %v", want, answered, got)
+		}
+	}
+}
+
+func TestUpstreamSlowAndErrors(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"reason":"NotFilteredNotFound","status":"NOERROR","upstream":"fast:53","elapsedMs":"12.5"},
+		{"reason":"NotFilteredNotFound","status":"NOERROR","upstream":"slow:53","elapsedMs":"812"},
+		{"reason":"NotFilteredNotFound","status":"NOERROR","upstream":"slow:53","elapsedMs":"950.1"},
+		{"reason":"NotFilteredNotFound","status":"NOERROR","upstream":"slow:53","elapsedMs":"40"},
+		{"reason":"NotFilteredNotFound","status":"NOERROR","upstream":"slow:53","elapsedMs":"900","cached":true},
+		{"reason":"NotFilteredError","status":"SERVFAIL","upstream":"slow:53","elapsedMs":"5000"},
+		{"reason":"NotFilteredNotFound","status":"SERVFAIL","upstream":"fast:53","elapsedMs":"3"},
+		{"reason":"FilteredBlackList","status":"NOERROR","elapsedMs":"0.2"}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+	before := map[string][2]float64{}
+	for _, up := range []string{"fast:53", "slow:53"} {
+		before[up] = [2]float64{
+			testutil.ToFloat64(upstreamSlow.WithLabelValues("test", up)),
+			testutil.ToFloat64(upstreamErrors.WithLabelValues("test", up)),
+		}
+	}
+
+	processQueryLog("test", logData.Data)
+
+	for up, want := range map[string][2]float64{"fast:53": {0, 1}, "slow:53": {3, 1}} {
+		if got := testutil.ToFloat64(upstreamSlow.WithLabelValues("test", up)) - before[up][0]; got != want[0] {
+			t.Errorf("Expected %v slow queries for %s, got %v", want[0], up, got)
+		}
+		if got := testutil.ToFloat64(upstreamErrors.WithLabelValues("test", up)) - before[up][1]; got != want[1] {
+			t.Errorf("Expected %v failed queries for %s, got %v", want[1], up, got)
+		}
+	}
+}
+
+func TestQueryBlockedByFilter(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"reason":"FilteredBlackList","rules":[{"filter_list_id":1,"text":"||ads.example^"}]},
+		{"reason":"FilteredBlackList","rules":[{"filter_list_id":1,"text":"||a^"},{"filter_list_id":1,"text":"||b^"},{"filter_list_id":4,"text":"||c^"}]},
+		{"reason":"FilteredBlackList","rule":"||tracker.example^","filterId":4},
+		{"reason":"FilteredBlackList","rule":"||custom.example^","filterId":0},
+		{"reason":"NotFilteredWhiteList","rules":[{"filter_list_id":1,"text":"@@||ok.example^"}]},
+		{"reason":"NotFilteredNotFound"}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+	if got := logData.Data[0].Rules; len(got) != 1 || got[0].FilterListID != 1 || got[0].Text != "||ads.example^" {
+		t.Errorf("Unexpected rules decoded from the rules array: %+v", got)
+	}
+	if q := logData.Data[2]; q.Rule != "||tracker.example^" || q.FilterID != 4 {
+		t.Errorf("Unexpected legacy rule decoded: %q from %d", q.Rule, q.FilterID)
+	}
+
+	before := map[string]float64{}
+	for _, id := range []string{"0", "1", "4"} {
+		before[id] = testutil.ToFloat64(queryBlockedByFilter.WithLabelValues("test", id))
+	}
+
+	processQueryLog("test", logData.Data)
+
+	for id, want := range map[string]float64{"0": 1, "1": 2, "4": 2} {
+		if got := testutil.ToFloat64(queryBlockedByFilter.WithLabelValues("test", id)) - before[id]; got != want {
+			t.Errorf("Expected %v blocked queries for filter %s, got %v", want, id, got)
+		}
+	}
+}
+
+func TestQueryLatencyExemplars(t *testing.T) {
+	defer func(enabled bool) { exemplarsEnabled = enabled }(exemplarsEnabled)
+	exemplar := func(client string) map[string]string {
+		var m dto.Metric
+		if err := queryHistogramByClient.WithLabelValues("exemplars", client).(prometheus.Metric).Write(&m); err != nil {
+			t.Fatalf("Failed to read histogram: %v", err)
+		}
+		for _, b := range m.GetHistogram().GetBucket() {
+			if e := b.GetExemplar(); e != nil {
+				labels := map[string]string{}
+				for _, l := range e.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				return labels
+			}
+		}
+		return nil
+	}
+
+	exemplarsEnabled = false
+	processQueryLog("exemplars", []QueryLogEntry{{Client: "10.0.0.1", Upstream: "1.1.1.1:53", Elapsed: "3.5"}})
+	if got := exemplar("10.0.0.1"); got != nil {
+		t.Errorf("Expected no exemplar while disabled, got %v", got)
+	}
+
+	exemplarsEnabled = true
+	processQueryLog("exemplars", []QueryLogEntry{{Client: "10.0.0.2", Upstream: "1.1.1.1:53", Elapsed: "3.5"}})
+	if got := exemplar("10.0.0.2"); got["client"] != "10.0.0.2" || got["upstream"] != "1.1.1.1:53" {
+		t.Errorf("Expected a client/upstream exemplar, got %v", got)
+	}
+
+	long := strings.Repeat("x", prometheus.ExemplarMaxRunes)
+	if got := exemplarLabels(clientObservation{client: "10.0.0.3", upstream: long}); got["upstream"] != "" || got["client"] != "10.0.0.3" {
+		t.Errorf("Expected an over-long upstream to be dropped, got %v", got)
+	}
+	if got := exemplarLabels(clientObservation{client: long}); got != nil {
+		t.Errorf("Expected no exemplar for an over-long client, got %v", got)
+	}
+}
+
+func TestQueryProto(t *testing.T) {
+	var logData AdGuardQueryLog
+	payload := `{"data":[
+		{"client_proto":"doh"},
+		{"client_proto":"doh"},
+		{"client_proto":"dot"},
+		{"client_proto":"doq"},
+		{"client_proto":"dnscrypt"},
+		{"client_proto":""},
+		{},
+		{"client_proto":"carrier-pigeon"}
+	]}`
+	if err := json.Unmarshal([]byte(payload), &logData); err != nil {
+		t.Fatalf("Failed to decode querylog: %v", err)
+	}
+	if got := logData.Data[0].ClientProto; got != "doh" {
+		t.Errorf("Expected client_proto doh to be decoded, got %q", got)
+	}
+	protos := []string{"plain", "doh", "dot", "doq", "dnscrypt"}
+	before := map[string]float64{}
+	for _, proto := range protos {
+		before[proto] = testutil.ToFloat64(queryCountByProto.WithLabelValues("test", proto))
+	}
+
+	processQueryLog("test", logData.Data)
+
+	for proto, want := range map[string]float64{"plain": 3, "doh": 2, "dot": 1, "doq": 1, "dnscrypt": 1} {
+		if got := testutil.ToFloat64(queryCountByProto.WithLabelValues("test", proto)) - before[proto]; got != want {
+			t.Errorf("Expected %v %s queries, got %v", want, proto, got)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeAdGuardResponses are canned bodies for every endpoint the exporter scrapes.
+var fakeAdGuardResponses = map[string]string{
+	"/control/stats": `{
+		"num_dns_queries": 1000,
+		"num_blocked_filtering": 100,
+		"num_replaced_parental": 3,
+		"num_replaced_safebrowsing": 2,
+		"num_replaced_safesearch": 1,
+		"avg_processing_time": 0.25,
+		"top_clients": [{"192.168.1.10": 600}, {"192.168.1.11": 400}]
+	}`,
+	"/control/status": `{
+		"version": "v0.107.52",
+		"dns_addresses": ["192.168.1.1", "fd00::1"],
+		"dns_port": 53,
+		"http_port": 3000,
+		"protection_enabled": true,
+		"running": true
+	}`,
+	"/control/querylog":             `{"data":[]}`,
+	"/control/dhcp/status":          `{"enabled":false}`,
+	"/control/filtering/status":     `{"enabled":true,"filters":[{"id":1,"enabled":true},{"id":2,"enabled":false}]}`,
+	"/control/safesearch/status":    `{"enabled":false}`,
+	"/control/blocked_services/get": `{"ids":[]}`,
+	"/control/stats/config":         `{"enabled":true,"interval":86400000}`,
+	"/control/clients":              `{"clients":[]}`,
+	"/control/rewrite/list":         `[]`,
+}
+
+// newFakeAdGuard serves fakeAdGuardResponses, with handlers in overrides taking
+// precedence, and points ADGUARD_HOST and the clients at it for the rest of
+// the test.
+func newFakeAdGuard(t *testing.T, overrides map[string]http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h, ok := overrides[r.URL.Path]; ok {
+			h(w, r)
+			return
+		}
+		body, ok := fakeAdGuardResponses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	reloadClients()
+	return srv
+}
+
+func TestUpdateMetricsAgainstFakeAdGuard(t *testing.T) {
+	srv := newFakeAdGuard(t, nil)
+	topClients.Reset()
+
+	updateMetrics(context.Background())
+
+	gauges := []struct {
+		name     string
+		vec      *prometheus.GaugeVec
+		expected float64
+	}{
+		{"dns queries", dnsQueries, 1000},
+		{"blocked filtering", blockedFiltering, 100},
+		{"blocked all", blockedAll, 106},
+		{"avg processing time", avgProcessingTime, 0.25},
+		{"running", statusRunning, 1},
+		{"protection", statusProtectionEnabled, 1},
+		{"dns port", statusDNSPort, 53},
+		{"dns addresses", statusDNSAddresses, 2},
+		{"stats retention", statsRetentionDays, 1},
+	}
+	for _, g := range gauges {
+		if got := testutil.ToFloat64(g.vec.WithLabelValues(srv.URL)); got != g.expected {
+			t.Errorf("%s: expected %v, got %v", g.name, g.expected, got)
+		}
+	}
+	if got := testutil.ToFloat64(filtersEnabled.WithLabelValues(srv.URL, "blocklist")); got != 1 {
+		t.Errorf("filters enabled: expected 1, got %v", got)
+	}
+
+	expected := fmt.Sprintf(`
+# HELP adguard_top_client_total Top client IPs, with the name AdGuard knows them by
+# TYPE adguard_top_client_total gauge
+adguard_top_client_total{client="192.168.1.10",instance=%[1]q,name="192.168.1.10"} 600
+adguard_top_client_total{client="192.168.1.11",instance=%[1]q,name="192.168.1.11"} 400
+`, srv.URL)
+	if err := testutil.CollectAndCompare(topClients, strings.NewReader(expected)); err != nil {
+		t.Errorf("Unexpected top clients: %v", err)
+	}
+}
+
+func TestUpdateMetricsMalformedJSON(t *testing.T) {
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"num_dns_queries": `))
+		},
+	})
+
+	if _, err := NewClient(target{Host: srv.URL}).Stats(context.Background()); err == nil {
+		t.Errorf("Expected an error for malformed stats JSON")
+	}
+
+	dnsQueries.WithLabelValues(srv.URL).Set(-1)
+	updateMetrics(context.Background())
+	if got := testutil.ToFloat64(dnsQueries.WithLabelValues(srv.URL)); got != -1 {
+		t.Errorf("Expected stats metrics to be left alone, got %v", got)
+	}
+	if got := testutil.ToFloat64(statusDNSPort.WithLabelValues(srv.URL)); got != 53 {
+		t.Errorf("Expected status metrics to still update, got %v", got)
+	}
+}
+
+func TestUpdateMetricsNon200(t *testing.T) {
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"running": false}`))
+		},
+	})
+
+	if _, err := NewClient(target{Host: srv.URL}).Status(context.Background()); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected a status 503 error, got %v", err)
+	}
+
+	statusRunning.WithLabelValues(srv.URL).Set(-1)
+	updateMetrics(context.Background())
+	if got := testutil.ToFloat64(statusRunning.WithLabelValues(srv.URL)); got != -1 {
+		t.Errorf("Expected status metrics to be left alone on a 503, got %v", got)
+	}
+	if got := testutil.ToFloat64(dnsQueries.WithLabelValues(srv.URL)); got != 1000 {
+		t.Errorf("Expected stats metrics to still update, got %v", got)
+	}
+}
+
+func TestUpdateMetricsMultipleInstances(t *testing.T) {
+	primary := newFakeAdGuard(t, nil)
+	secondary := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats": func(w http.ResponseWriter, r *http.Request) {
+			if user, _, _ := r.BasicAuth(); user != "second" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"num_dns_queries": 2000, "top_clients": [{"10.0.0.5": 2000}]}`))
+		},
+	})
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	t.Setenv("ADGUARD_HOSTS", strings.Join([]string{primary.URL, secondary.URL, down.URL}, ","))
+	t.Setenv("ADGUARD_USERS", "first,second,third")
+	t.Setenv("ADGUARD_PASSES", "a,b,c")
+	reloadClients()
+
+	updateMetrics(context.Background())
+
+	for instance, want := range map[string]float64{primary.URL: 1000, secondary.URL: 2000} {
+		if got := testutil.ToFloat64(dnsQueries.WithLabelValues(instance)); got != want {
+			t.Errorf("%s: expected %v queries, got %v", instance, want, got)
+		}
+	}
+	// Refreshing the secondary must not wipe the primary's top clients.
+	if got := testutil.ToFloat64(topClients.WithLabelValues(primary.URL, "192.168.1.10", "192.168.1.10")); got != 600 {
+		t.Errorf("Expected the primary's top clients to survive, got %v", got)
+	}
+	if got := testutil.ToFloat64(topClients.WithLabelValues(secondary.URL, "10.0.0.5", "10.0.0.5")); got != 2000 {
+		t.Errorf("Expected the secondary's top clients, got %v", got)
+	}
+	if n := testutil.CollectAndCount(dnsQueries); n == 0 {
+		t.Fatalf("Expected dns query series")
+	}
+	if _, err := NewClient(target{Host: down.URL}).Stats(context.Background()); err == nil {
+		t.Errorf("Expected the unreachable instance to fail")
+	}
+}
+
+func TestTargets(t *testing.T) {
+	t.Setenv("ADGUARD_HOST", "http://single:3000")
+	if got := targets(); len(got) != 1 || got[0].Host != "http://single:3000" {
+		t.Errorf("Expected ADGUARD_HOST as the only target, got %+v", got)
+	}
+
+	t.Setenv("ADGUARD_HOSTS", `[{"host":"http://a:3000","user":"u1","pass":"p,1"},{"host":"http://b:3000"}]`)
+	got := targets()
+	if len(got) != 2 || got[0].Pass != "p,1" || got[1].Host != "http://b:3000" {
+		t.Errorf("Unexpected JSON targets: %+v", got)
+	}
+	t.Setenv("ADGUARD_USER", "fallback")
+	if user, pass := NewClient(got[0]).credentials("stats"); user != "u1" || pass != "p,1" {
+		t.Errorf("Expected the instance's own credentials, got %s/%s", user, pass)
+	}
+	if user, _ := NewClient(got[1]).credentials("stats"); user != "fallback" {
+		t.Errorf("Expected ADGUARD_USER as fallback, got %s", user)
+	}
+
+	t.Setenv("STATS_USER", "stats-proxy")
+	t.Setenv("DHCP_USER", "unrelated")
+	if user, _ := NewClient(got[0]).credentials("stats"); user != "u1" {
+		t.Errorf("Expected the instance's credentials to win over STATS_USER, got %s", user)
+	}
+	if user, _ := NewClient(got[1]).credentials("stats"); user != "stats-proxy" {
+		t.Errorf("Expected STATS_USER for an instance without credentials, got %s", user)
+	}
+	if user, _ := NewClient(got[1]).credentials("dhcp"); user != "fallback" {
+		t.Errorf("Expected DHCP_USER to be ignored, got %s", user)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"http://192.168.1.1:3000":      "http://192.168.1.1:3000",
+		"https://adguard.example.com":  "https://adguard.example.com",
+		"192.168.1.1:3000":             "http://192.168.1.1:3000",
+		"adguard.lan":                  "http://adguard.lan",
+		"http://host/":                 "http://host",
+		"http://host:3000//":           "http://host:3000",
+		"192.168.1.1:3000/":            "http://192.168.1.1:3000",
+		"https://example.com/adguard/": "https://example.com/adguard",
+		" http://host ":                "http://host",
+		"":                             "",
+	} {
+		if got := normalizeHost(host); got != want {
+			t.Errorf("normalizeHost(%q): expected %q, got %q", host, want, got)
+		}
+	}
+
+	t.Setenv("ADGUARD_HOSTS", "10.0.0.1:3000/, http://10.0.0.2:3000/")
+	if got := targets(); len(got) != 2 || got[0].Host != "http://10.0.0.1:3000" || got[1].Host != "http://10.0.0.2:3000" {
+		t.Errorf("Expected normalized targets, got %+v", got)
+	}
+}
+
+func TestEndpointURL(t *testing.T) {
+	cases := []struct{ host, base, want string }{
+		{"http://host:3000", "", "http://host:3000/control/stats"},
+		{"http://host:3000/", "/adguard", "http://host:3000/adguard/control/stats"},
+		{"https://home.example.com", "adguard/", "https://home.example.com/adguard/control/stats"},
+		{"home.example.com/", "//apps/adguard//", "http://home.example.com/apps/adguard/control/stats"},
+		{"http://host:3000", "/", "http://host:3000/control/stats"},
+	}
+	for _, tc := range cases {
+		t.Setenv("ADGUARD_BASE_PATH", tc.base)
+		if got := endpointURL(tc.host, "/control/stats"); got != tc.want {
+			t.Errorf("host=%q base=%q: expected %q, got %q", tc.host, tc.base, tc.want, got)
+		}
+	}
+}
+
+func TestFetchWithBasePath(t *testing.T) {
+	srv := httptest.NewServer(http.StripPrefix("/adguard", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/control/stats" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(fakeAdGuardResponses["/control/stats"]))
+	})))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	t.Setenv("ADGUARD_BASE_PATH", "/adguard/")
+
+	stats, err := NewClient(target{Host: srv.URL}).Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the prefixed endpoint to be fetched, got %v", err)
+	}
+	if stats.NumDNSQueries != 1000 {
+		t.Errorf("Expected 1000 queries, got %v", stats.NumDNSQueries)
+	}
+}
+
+func TestFetchWithTrailingSlashHost(t *testing.T) {
+	srv := newFakeAdGuard(t, nil)
+	stats, err := NewClient(target{Host: srv.URL + "/"}).Stats(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the trailing slash to be dropped, got %v", err)
+	}
+	if stats.NumDNSQueries != 1000 {
+		t.Errorf("Expected 1000 queries, got %v", stats.NumDNSQueries)
+	}
+}
+
+func TestAdGuardUp(t *testing.T) {
+	srv := newFakeAdGuard(t, nil)
+	updateMetrics(context.Background())
+	if got := testutil.ToFloat64(adguardUp.WithLabelValues(srv.URL)); got != 1 {
+		t.Errorf("Expected adguard_up 1 when every endpoint succeeds, got %v", got)
+	}
+
+	for _, endpoint := range []string{"stats", "status", "querylog"} {
+		srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+			"/control/" + endpoint: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		})
+		updateMetrics(context.Background())
+
+		if got := testutil.ToFloat64(adguardUp.WithLabelValues(srv.URL)); got != 0 {
+			t.Errorf("%s failing: expected adguard_up 0, got %v", endpoint, got)
+		}
+		for _, e := range []string{"stats", "status", "querylog"} {
+			want := boolToFloat(e != endpoint)
+			if got := testutil.ToFloat64(endpointUp.WithLabelValues(srv.URL, e)); got != want {
+				t.Errorf("%s failing: expected adguard_endpoint_up{endpoint=%q} %v, got %v", endpoint, e, want, got)
+			}
+		}
+	}
+}
+
+func TestScrapeErrorsCountedPerEndpoint(t *testing.T) {
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/status": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	})
+	before := map[string]float64{}
+	for _, e := range []string{"stats", "status", "querylog"} {
+		before[e] = testutil.ToFloat64(scrapeErrors.WithLabelValues(srv.URL, e))
+	}
+
+	updateMetrics(context.Background())
+	updateMetrics(context.Background())
+
+	for e, want := range map[string]float64{"stats": 0, "status": 2, "querylog": 0} {
+		if got := testutil.ToFloat64(scrapeErrors.WithLabelValues(srv.URL, e)) - before[e]; got != want {
+			t.Errorf("Expected %v errors for %s, got %v", want, e, got)
+		}
+	}
+}
+
+func TestTopClientNames(t *testing.T) {
+	clientFetches := 0
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/clients": func(w http.ResponseWriter, r *http.Request) {
+			clientFetches++
+			w.Write([]byte(`{"clients":[{"name":"laptop","ids":["192.168.1.10","aa:bb:cc:dd:ee:ff"]}],
+				"auto_clients":[{"name":"phone.lan","ip":"192.168.1.11","source":"rDNS"},{"name":"laptop.lan","ip":"192.168.1.10","source":"rDNS"}]}`))
+		},
+		"/control/stats": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"top_clients":[{"192.168.1.10":600},{"192.168.1.11":400},{"192.168.1.12":5}]}`))
+		},
+	})
+	updateMetrics(context.Background())
+	updateMetrics(context.Background())
+
+	for _, c := range []struct{ ip, name string }{
+		{"192.168.1.10", "laptop"},
+		{"192.168.1.11", "phone.lan"},
+		{"192.168.1.12", "192.168.1.12"},
+	} {
+		if got := testutil.ToFloat64(topClients.WithLabelValues(srv.URL, c.ip, c.name)); got == 0 {
+			t.Errorf("Expected %s to be named %q", c.ip, c.name)
+		}
+	}
+	// Both scrapes fall within CLIENT_NAME_TTL, so /control/clients is only
+	// fetched once.
+	if clientFetches != 1 {
+		t.Errorf("Expected the clients to be cached, got %d fetches", clientFetches)
+	}
+}
+
+func TestCoreEndpointsFetchedConcurrently(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var calls atomic.Int32
+	var inFlight atomic.Int64
+	slow := func(path string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			time.Sleep(delay)
+			if n := int64(testutil.ToFloat64(scrapeGoroutines)); n > inFlight.Load() {
+				inFlight.Store(n)
+			}
+			w.Write([]byte(fakeAdGuardResponses[path]))
+		}
+	}
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/stats":    slow("/control/stats"),
+		"/control/status":   slow("/control/status"),
+		"/control/querylog": slow("/control/querylog"),
+	})
+
+	start := time.Now()
+	if !updateInstance(context.Background(), NewClient(target{Host: srv.URL}), nil) {
+		t.Errorf("Expected every core endpoint to succeed")
+	}
+	elapsed := time.Since(start)
+
+	if n := calls.Load(); n != 3 {
+		t.Errorf("Expected stats, status and querylog to be fetched, got %d calls", n)
+	}
+	if elapsed >= 2*delay {
+		t.Errorf("Expected the cycle to take about the slowest call (%s), took %s", delay, elapsed)
+	}
+	if n := inFlight.Load(); n < 3 {
+		t.Errorf("Expected the endpoint goroutines to be counted while in flight, got %d", n)
+	}
+	if got := testutil.ToFloat64(scrapeGoroutines); got != 0 {
+		t.Errorf("Expected no scrape goroutines after the cycle, got %v", got)
+	}
+}
+
+func TestQueryLogDisabled(t *testing.T) {
+	if os.Getenv("ENABLE_QUERYLOG") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestQueryLogDisabled$")
+		cmd.Env = append(os.Environ(), "ENABLE_QUERYLOG=false")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Run with ENABLE_QUERYLOG=false failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	var queryLogCalls atomic.Int32
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/querylog": func(w http.ResponseWriter, r *http.Request) {
+			queryLogCalls.Add(1)
+			w.Write([]byte(fakeAdGuardResponses["/control/querylog"]))
+		},
+	})
+	if !updateInstance(context.Background(), NewClient(target{Host: srv.URL}), nil) {
+		t.Errorf("Expected the cycle to succeed without the querylog")
+	}
+	if n := queryLogCalls.Load(); n != 0 {
+		t.Errorf("Expected /control/querylog not to be fetched, got %d calls", n)
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	for _, mf := range mfs {
+		if name := mf.GetName(); strings.HasPrefix(name, "adguard_query") || name == "adguard_cache_hit_ratio" {
+			t.Errorf("Expected no querylog metrics, got %s", name)
+		}
+	}
+	if err := prometheus.Register(queryLogEntriesProcessed); err != nil {
+		t.Errorf("Expected the querylog collectors to be unregistered: %v", err)
+	}
+}
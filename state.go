@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// persistedCounters are the querylog counters saved to STATE_FILE so their
+// totals survive restarts. Histograms can't be seeded and are not persisted.
+var persistedCounters = map[string]*prometheus.CounterVec{
+	"adguard_query_reason_total":        queryCountByReason,
+	"adguard_query_type_total":          queryCountByType,
+	"adguard_query_upstream_total":      queryCountByUpstream,
+	"adguard_upstream_slow_total":       upstreamSlow,
+	"adguard_upstream_errors_total":     upstreamErrors,
+	"adguard_query_domain_total":        queryCountByDomain,
+	"adguard_query_client_reason_total": queryCountClientReason,
+	"adguard_rewrite_hits_total":        rewriteHits,
+	"adguard_blocked_service_total":     blockedServices,
+	"adguard_query_rcode_total":         queryCountByRcode,
+	"adguard_query_answered_total":      queryAnswered,
+	"adguard_query_tld_total":           queryCountByTLD,
+
+	"adguard_querylog_incomplete_entries_total": queryLogIncomplete,
+	"adguard_querylog_entries_total":            queryLogEntries,
+	"adguard_query_blocked_by_filter_total":     queryBlockedByFilter,
+	"adguard_query_proto_total":                 queryCountByProto,
+}
+
+type counterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// counterState maps a metric name to the values of all its series.
+type counterState map[string][]counterSample
+
+// persistedState is the STATE_FILE layout. Next to the counters it keeps each
+// instance's querylog cursor, so the entries the counters already include
+// aren't counted again after a restart. Files written before the cursors
+// were added hold a bare counterState.
+type persistedState struct {
+	Counters      counterState              `json:"counters"`
+	LastSeenQuery map[string]time.Time      `json:"last_seen_query,omitempty"`
+	LastWindowEnd map[string]time.Time      `json:"last_window_end,omitempty"`
+	Resumes       map[string]queryLogResume `json:"querylog_resume,omitempty"`
+}
+
+func snapshotCounters() (counterState, error) {
+	state := counterState{}
+	for name, vec := range persistedCounters {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			vec.Collect(ch)
+			close(ch)
+		}()
+		for m := range ch {
+			var d dto.Metric
+			if err := m.Write(&d); err != nil {
+				return nil, err
+			}
+			labels := make(map[string]string, len(d.GetLabel()))
+			for _, lp := range d.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			state[name] = append(state[name], counterSample{Labels: labels, Value: d.GetCounter().GetValue()})
+		}
+	}
+	return state, nil
+}
+
+// saveState writes the current counter values to path. The file is written to
+// a temporary file first and renamed into place so a crash never leaves a
+// half-written state behind.
+func saveState(path string) error {
+	counters, err := snapshotCounters()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(persistedState{Counters: counters, LastSeenQuery: lastSeenQuery, LastWindowEnd: lastWindowEnd, Resumes: queryLogResumes})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState seeds the persisted counters and querylog cursors from path. A
+// missing file is not an error; a corrupt one is reported and leaves the
+// counters untouched.
+func loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		logX("INFO", "No state file at %s, starting fresh", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	seeded := 0
+	for name, samples := range state.Counters {
+		vec, ok := persistedCounters[name]
+		if !ok {
+			continue
+		}
+		for _, s := range samples {
+			c, err := vec.GetMetricWith(s.Labels)
+			if err != nil || s.Value < 0 {
+				logX("WARN", "Skipping invalid state entry for %s: %v", name, s.Labels)
+				continue
+			}
+			c.Add(s.Value)
+			seeded++
+		}
+	}
+	for instance, t := range state.LastSeenQuery {
+		lastSeenQuery[instance] = t
+	}
+	for instance, t := range state.LastWindowEnd {
+		lastWindowEnd[instance] = t
+	}
+	for instance, r := range state.Resumes {
+		queryLogResumes[instance] = r
+	}
+	logX("INFO", "Restored %d counter series and %d querylog cursors from %s", seeded, len(state.LastSeenQuery)+len(state.LastWindowEnd), path)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	for _, vec := range persistedCounters {
+		vec.Reset()
+	}
+	queryCountByReason.WithLabelValues("test", "FilteredBlackList").Add(12)
+	queryCountClientReason.WithLabelValues("test", "192.168.1.5", "Rewrite").Add(4)
+
+	if err := saveState(path); err != nil {
+		t.Fatalf("saveState failed: %v", err)
+	}
+
+	// Simulate a restart.
+	for _, vec := range persistedCounters {
+		vec.Reset()
+	}
+	if err := loadState(path); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+
+	if got := testutil.ToFloat64(queryCountByReason.WithLabelValues("test", "FilteredBlackList")); got != 12 {
+		t.Errorf("Expected reason counter to be restored to 12, got %v", got)
+	}
+	if got := testutil.ToFloat64(queryCountClientReason.WithLabelValues("test", "192.168.1.5", "Rewrite")); got != 4 {
+		t.Errorf("Expected client/reason counter to be restored to 4, got %v", got)
+	}
+
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("Expected temporary files to be cleaned up, found %v", matches)
+	}
+}
+
+func TestLoadStateMissingOrCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	if err := loadState(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("Expected a missing state file to be ignored, got %v", err)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	os.WriteFile(corrupt, []byte("{not json"), 0o600)
+	if err := loadState(corrupt); err == nil {
+		t.Errorf("Expected an error for a corrupt state file")
+	}
+}
+
+func TestRestartDoesNotRecountQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	page := `{"data":[
+		{"client":"10.0.0.1","reason":"NotFilteredNotFound","time":"2024-05-06T10:00:02Z","elapsedMs":"1"},
+		{"client":"10.0.0.2","reason":"NotFilteredNotFound","time":"2024-05-06T10:00:01Z","elapsedMs":"1"}
+	]}`
+	srv := newFakeAdGuard(t, map[string]http.HandlerFunc{
+		"/control/querylog": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(page)) },
+	})
+	delete(lastSeenQuery, srv.URL)
+	entries := func() float64 { return testutil.ToFloat64(queryLogEntries.WithLabelValues(srv.URL)) }
+
+	updateInstance(context.Background(), NewClient(target{Host: srv.URL}), nil)
+	if got := entries(); got != 2 {
+		t.Fatalf("Expected 2 entries counted before the restart, got %v", got)
+	}
+	if err := saveState(path); err != nil {
+		t.Fatalf("saveState failed: %v", err)
+	}
+
+	// Simulate a restart: counters and cursors start empty, then STATE_FILE is loaded.
+	for _, vec := range persistedCounters {
+		vec.Reset()
+	}
+	delete(lastSeenQuery, srv.URL)
+	if err := loadState(path); err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	updateInstance(context.Background(), NewClient(target{Host: srv.URL}), nil)
+
+	if got := entries(); got != 2 {
+		t.Errorf("Expected the restored total of 2 without recounting the same page, got %v", got)
+	}
+}
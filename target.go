@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// target is one AdGuard Home instance to scrape. Its host doubles as the value
+// of the instance label.
+type target struct {
+	Host string `json:"host"`
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// targets returns the configured instances. ADGUARD_HOSTS is either a
+// comma-separated list, paired by position with ADGUARD_USERS and
+// ADGUARD_PASSES, or a JSON list of {"host", "user", "pass"} objects. Without
+// it ADGUARD_HOST is the single instance. Missing credentials fall back to
+// ADGUARD_USER/ADGUARD_PASS in NewClient.
+func targets() []target {
+	raw := strings.TrimSpace(os.Getenv("ADGUARD_HOSTS"))
+	if raw == "" {
+		return []target{{Host: normalizeHost(os.Getenv("ADGUARD_HOST"))}}
+	}
+
+	if strings.HasPrefix(raw, "[") {
+		var list []target
+		if err := json.Unmarshal([]byte(raw), &list); err != nil {
+			logX("ERROR", "Failed to parse ADGUARD_HOSTS as JSON: %v", err)
+			return nil
+		}
+		for i := range list {
+			list[i].Host = normalizeHost(list[i].Host)
+		}
+		return list
+	}
+
+	users := strings.Split(os.Getenv("ADGUARD_USERS"), ",")
+	passes := strings.Split(os.Getenv("ADGUARD_PASSES"), ",")
+	var list []target
+	for i, host := range strings.Split(raw, ",") {
+		t := target{Host: normalizeHost(host)}
+		if t.Host == "" {
+			continue
+		}
+		if i < len(users) {
+			t.User = strings.TrimSpace(users[i])
+		}
+		if i < len(passes) {
+			t.Pass = passes[i]
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+// normalizeHost tidies a host as users tend to paste it: http:// is assumed
+// when there is no scheme and trailing slashes are dropped, so appending an
+// endpoint path like /control/stats always yields a well-formed URL.
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return ""
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimRight(host, "/")
+}
+
+// endpointURL joins host, ADGUARD_BASE_PATH and an API path such as
+// /control/stats, whatever slashes the host and base path come with.
+func endpointURL(host, path string) string {
+	url := normalizeHost(host)
+	if base := strings.Trim(os.Getenv("ADGUARD_BASE_PATH"), "/ "); base != "" {
+		url += "/" + base
+	}
+	return url + path
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate with the given serial number.
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+func servedSerial(t *testing.T, url string) int64 {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("TLS request failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloaderPicksUpNewCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// StartTLS would install httptest's own certificate, so wrap the listener instead.
+	srv.Listener = tls.NewListener(srv.Listener, reloader.tlsConfig())
+	srv.Start()
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	if got := servedSerial(t, url); got != 1 {
+		t.Fatalf("Expected initial certificate serial 1, got %d", got)
+	}
+
+	writeTestCert(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	if got := servedSerial(t, url); got != 2 {
+		t.Errorf("Expected renewed certificate serial 2, got %d", got)
+	}
+}
+
+func TestClientTLSVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"num_dns_queries": 5}`))
+	}))
+	defer srv.Close()
+	t.Setenv("ADGUARD_HOST", srv.URL)
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+
+	tests := []struct {
+		name       string
+		caFile     string
+		skipVerify bool
+		wantErr    bool
+	}{
+		{"system roots", "", false, true},
+		{"custom CA", caFile, false, false},
+		{"skip verify", "", true, false},
+	}
+	for _, tt := range tests {
+		cfg, err := clientTLSConfig(tt.caFile, tt.skipVerify)
+		if err != nil {
+			t.Fatalf("%s: clientTLSConfig failed: %v", tt.name, err)
+		}
+		httpClient = newHTTPClient(time.Second, cfg, nil)
+		_, err = NewClient(target{Host: srv.URL}).Stats(context.Background())
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: expected the self-signed certificate to be rejected", tt.name)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: expected the request to succeed, got %v", tt.name, err)
+		}
+	}
+
+	if _, err := clientTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), false); err == nil {
+		t.Errorf("Expected a missing CA file to be reported")
+	}
+	os.WriteFile(caFile, []byte("not a certificate"), 0o600)
+	if _, err := clientTLSConfig(caFile, false); err == nil {
+		t.Errorf("Expected a CA file without certificates to be reported")
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute URL of the target.
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(`{"version":"v0.107.52","running":true}`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := parseProxyURL(proxy.URL)
+	if err != nil {
+		t.Fatalf("parseProxyURL failed: %v", err)
+	}
+	httpClient = newHTTPClient(time.Second, nil, proxyURL)
+
+	// adguard.invalid doesn't resolve, so only the proxy can answer.
+	status, err := NewClient(target{Host: "http://adguard.invalid:3000"}).Status(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the request to go through the proxy, got %v", err)
+	}
+	if !status.Running || len(proxied) != 1 || proxied[0] != "http://adguard.invalid:3000/control/status" {
+		t.Errorf("Expected one proxied request for /control/status, got %v", proxied)
+	}
+
+	for raw, wantErr := range map[string]bool{
+		"":                       false,
+		"socks5://bastion:1080":  false,
+		"http://user:pw@px:3128": false,
+		"ftp://px:21":            true,
+		"socks5://":              true,
+		"://bad":                 true,
+	} {
+		if _, err := parseProxyURL(raw); (err != nil) != wantErr {
+			t.Errorf("parseProxyURL(%q): expected error %v, got %v", raw, wantErr, err)
+		}
+	}
+}